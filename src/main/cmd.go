@@ -0,0 +1,104 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+)
+
+//命令名称
+const (
+	Cmd_Update   = "update"
+	Cmd_Explain  = "explain"
+	Cmd_Init     = "init"
+	Cmd_Daemon   = "daemon"
+	Cmd_Discover = "discover"
+	Cmd_Status   = "status"
+	Cmd_Plan     = "plan"
+	Cmd_Apply    = "apply"
+	Cmd_Rollback = "rollback"
+	Cmd_Resume   = "resume"
+)
+
+//Cmd_Usage 命令的使用说明,每个命令的参数通过 命令 -h 查看
+const Cmd_Usage = `usage: UpdateProgram [command] [flags]
+
+commands:
+  update    update all target servers (default)
+  explain   print the resolved config and the derived update targets with where each value came from
+  init      create a config interactively, checking the source and target dirs while asking
+  discover  list every serverID found by target_layout or inventory and whether it will be updated, with the reason
+  status    compare the files of every target with the source files by size, SHA-256 and version, report up-to-date, outdated, drifted or missing files
+  plan      write every target and file action of the update with the SHA-256 of the source files to a plan file for review
+  apply     update by a plan file, refused if the source files, the targets, the hook commands, the rollout policy or the actions changed since the plan was made, uses the config and profile of the plan
+  rollback  restore the files of -server from the latest backup (or the one of -to), restart the service and verify the version
+  resume    finish or roll back the target an interrupted update was working on, then update the remaining targets
+  daemon    keep running, reload the config when it changes, with -auto_update also update when exe_version changes
+
+run "UpdateProgram <command> -h" to show the flags of a command
+`
+
+//CmdFlags 各命令共用的启动参数:配置文件,命名更新配置以及每个配置项的覆盖参数
+type CmdFlags struct {
+	*flag.FlagSet
+	config   *string
+	profile  *string
+	encoding *string
+}
+
+func NewCmdFlags(name string) *CmdFlags {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	cf := &CmdFlags{
+		FlagSet: fs,
+		config:  fs.String("config", os.Getenv(Cfg_Env_Prefix+"CONFIG"), "config file path (.ini .json .yaml .yml .toml), default is config\\config.ini next to the program, env UPDATEPROGRAM_CONFIG"),
+		profile: fs.String("profile", os.Getenv(Cfg_Env_Prefix+"PROFILE"), "use the [Profile:name] section of the config, default only use [Update_Cfg], env UPDATEPROGRAM_PROFILE"),
+		encoding: fs.String("encoding", envOr(Cfg_Env_Prefix+"ENCODING", Encoding_Auto), "config file encoding ("+strings.Join(CfgEncodings, " ")+"), auto detects by BOM and content, "+
+			"also the encoding of the generated config template (auto means "+Encoding_Template+"), env UPDATEPROGRAM_ENCODING"),
+	}
+	RegisterCfgFlags(fs)
+	return cf
+}
+
+//CfgPath 获取配置文件路径,启动参数指定了配置文件时优先使用
+func (cf *CmdFlags) CfgPath() (string, error) {
+	if len(*cf.config) == 0 {
+		return GetCfgPath(*cf.encoding)
+	}
+
+	if !PathExists(*cf.config) {
+		return *cf.config, fmt.Errorf("config %s not exists", *cf.config)
+	}
+	return *cf.config, nil
+}
+
+//LoadCfg 加载配置文件,启动参数和环境变量中的配置项会覆盖配置文件中的值,需要先Parse
+func (cf *CmdFlags) LoadCfg() (*UpdateCfg, error) {
+	if msg := checkEncoding(*cf.encoding); msg != "" {
+		return nil, fmt.Errorf("flag -encoding %s", msg)
+	}
+
+	cfgpath, err := cf.CfgPath()
+	if err != nil {
+		return nil, err
+	}
+
+	logU.InfoDoo("Load config:", cfgpath, "profile:", *cf.profile, "encoding:", *cf.encoding)
+	updateCfg := NewUpdateCfg()
+	updateCfg.SetEncoding(*cf.encoding)
+	updateCfg.SetOverrides(CfgOverrides(cf.FlagSet))
+	if err := updateCfg.LoadProfile(cfgpath, *cf.profile); err != nil {
+		return nil, fmt.Errorf("Load config %s fail: %s", cfgpath, err)
+	}
+
+	return updateCfg, nil
+}
+
+//envOr 获取环境变量,不存在时返回默认值
+func envOr(name, def string) string {
+	if value, ok := os.LookupEnv(name); ok {
+		return value
+	}
+	return def
+}
@@ -1,12 +1,42 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/ini"
 
 )
 
+//配置文件中的节名称
+const (
+	Section_Signature  = "Signature"
+	Section_Update_Cfg = "Update_Cfg"
+
+	//写在所有节之前(json/yaml/toml中为最外层)的配置项所在的节,只能包含extends和include,与ini.DefaultSection一致
+	Section_Default = "DEFAULT"
+
+	//命名更新配置的节名前缀,如[Profile:mt5-prod],未配置的项继承[Signature]和[Update_Cfg]
+	Section_Profile_Prefix = "Profile:"
+
+	//组件的节名前缀,[Component:名称]中可包含[Signature]和[Update_Cfg]中的任意配置项
+	Section_Component_Prefix = "Component:"
+)
+
+//配置项的来源
+const (
+	Cfg_From_File    = "file"
+	Cfg_From_Default = "default"
+	Cfg_From_Env     = "env"
+	Cfg_From_Flag    = "flag"
+	Cfg_From_Derived = "derived" //由其它配置项推导得出
+)
+
 type UpdateCfg struct {
 	author              string
 	exe_version         string
@@ -15,10 +45,40 @@ type UpdateCfg struct {
 	target_dir          string
 	source_file_suffix  string
 	server_type         string
+	target_layout       string //目标目录布局,为空时使用Layout_Default
+	inventory           string //服务器清单文件,不为空时使用清单中的目标代替扫描target_dir
 	server_prefix       string
-	not_update_serverid string //不需要更新的serverID 字符串中使用逗号隔开
+	service_name        string //服务名模板
+	target_exe_name     string //目标exe文件名模板
+	display_name        string //显示名模板,用于日志和更新结果
+	update_serverid     string //需要更新的serverID选择条件,为空表示全部 字符串中使用逗号隔开
+	not_update_serverid string //不需要更新的serverID选择条件 字符串中使用逗号隔开
+	update_order        string //更新顺序的策略
+	update_priority     string //update_order为priority时优先更新的serverID选择条件,按书写顺序更新
 	backup_file_num     int
-	update_stop_flag    int //更新停止标识是否启用（等于1启用:当更新到某个服务并且重启失败时就停止后续的更新，为0不启用）
+	update_stop_flag    int                 //更新停止标识是否启用（等于1启用:当更新到某个服务并且重启失败时就停止后续的更新，为0不启用）
+	update_parallel     int                 //同时更新的目标个数
+	canary_serverid     string              //分阶段更新时第一个阶段(金丝雀)的serverID选择条件
+	canary_count        int                 //分阶段更新时第一个阶段更新的目标个数,与canary_serverid二选一
+	batch_size          int                 //金丝雀之后每个阶段更新的目标个数,0表示剩下的一次更新
+	soak_time           time.Duration       //阶段之间等待的时长,之后进行健康检查
+	health_check        string              //健康检查时对每个已更新的目标执行的命令,退出码不为0表示检查失败
+	hook_pre_backup     string              //备份目标文件之前执行的钩子命令
+	hook_post_copy      string              //拷贝源文件之后执行的钩子命令
+	hook_pre_restart    string              //重启服务之前执行的钩子命令
+	hook_post_restart   string              //重启服务成功之后执行的钩子命令
+	hook_on_failure     string              //目标更新失败并回滚之后执行的钩子命令
+	hook_timeout        time.Duration       //钩子命令的超时时间
+	components          string              //按顺序更新的组件名称,逗号隔开,为空时只更新当前配置
+	component           string              //组件名称,为空表示不是组件
+	component_cfgs      []*UpdateCfg        //components中每个组件合并后的配置
+	profile             string              //当前使用的命名更新配置,为空表示只使用[Update_Cfg]
+	overrides           map[string]*cfgItem //来自启动参数和环境变量的配置项,会覆盖配置文件中的值
+	sources             map[string]*cfgItem //配置项名称 + 最终生效的值及其来源
+	path                string              //配置文件路径
+	files               []string            //配置文件及其extends和include的所有文件
+	encoding            string              //配置文件编码,为auto时自动检测
+	detected            string              //配置文件实际使用的编码
 	mu                  sync.RWMutex
 }
 
@@ -26,62 +86,337 @@ func NewUpdateCfg() *UpdateCfg {
 	return &UpdateCfg{}
 }
 
+//Load 加载配置文件并校验所有配置项,存在问题时返回CfgIssues(包含所有问题及其所在行号)
 func (upcfg *UpdateCfg) Load(path string) error {
-	cfg, err := ini.Load(path)
+	return upcfg.LoadProfile(path, "")
+}
+
+//LoadProfile 加载配置文件中名为profile的更新配置,profile为空时只使用[Signature]和[Update_Cfg]
+func (upcfg *UpdateCfg) LoadProfile(path, profile string) error {
+	upcfg.mu.RLock()
+	encoding := upcfg.encoding
+	upcfg.mu.RUnlock()
+
+	sections, files, detected, err := loadCfgTree(path, encoding, nil)
 	if err != nil {
 		return err
 	}
 
+	if len(profile) > 0 {
+		if sections, err = sections.mergeNamed(Section_Profile_Prefix, profile); err != nil {
+			return err
+		}
+	}
+
 	upcfg.mu.Lock()
 	defer upcfg.mu.Unlock()
 
-	upcfg.author = ""
-	upcfg.exe_version = ""
-	if sec, er := cfg.GetSection("Signature"); er == nil {
-		if sec.HasKey("author") {
-			upcfg.author = sec.Key("author").String()
-			upcfg.exe_version = sec.Key("exe_version").String()
+	//组件在合并启动参数和环境变量之前的配置上覆盖自己的配置项
+	raw := make(cfgSections, len(sections))
+	raw.merge(sections)
+	sections.mergeOverrides(upcfg.overrides)
+	upcfg.path = path
+	upcfg.files = files
+	upcfg.detected = detected
+	upcfg.profile = profile
+
+	issues := checkUnknownKeys(sections)
+	issues = append(issues, upcfg.apply(sections)...)
+	issues = append(issues, upcfg.applyComponents(raw, issues)...)
+	if len(issues) > 0 {
+		issues.Sort()
+		return issues
+	}
+
+	return nil
+}
+
+//apply 按cfgKeySpecs把原始配置项解析到各个字段中,返回校验不通过的所有问题
+func (upcfg *UpdateCfg) apply(sections cfgSections) CfgIssues {
+	issues := make(CfgIssues, 0)
+	upcfg.sources = make(map[string]*cfgItem, len(cfgKeySpecs))
+	for _, spec := range cfgKeySpecs {
+		//配置项不存在或者留空时使用默认值
+		file, line := sections.line(spec.section)
+		source := &cfgItem{value: spec.def, file: file, line: line, from: Cfg_From_Default}
+		if item := sections.item(spec.section, spec.key); item != nil {
+			if len(strings.TrimSpace(item.value)) > 0 || spec.required {
+				source = item
+			}
+		}
+
+		if msg := spec.validate(source.value); msg != "" {
+			issues = append(issues, CfgIssue{File: source.file, Line: source.line, From: source.from, Section: spec.section, Key: spec.key, Msg: msg})
+			continue
 		}
+		spec.set(upcfg, source.value)
+		upcfg.sources[spec.key] = source
 	}
 
-	upcfg.source_dir = ""
-	upcfg.source_exe_name = ""
-	upcfg.target_dir = ""
-	upcfg.source_file_suffix = ""
-	upcfg.server_type = ""
-	upcfg.server_prefix = ""
-	upcfg.not_update_serverid = ""
-	upcfg.backup_file_num = 3
-	upcfg.update_stop_flag = 0
-	if sec, er := cfg.GetSection("Update_Cfg"); er == nil {
-		if sec.HasKey("source_dir") {
-			upcfg.source_dir = sec.Key("source_dir").String()
+	//各配置项之间的关联校验只在单项校验都通过时进行
+	if len(issues) == 0 {
+		issues = append(issues, upcfg.checkRelation(sections)...)
+	}
+
+	issues.Sort()
+	return issues
+}
+
+//cfgItem 配置项的原始值,来源以及来自配置文件时所在的文件和行号
+type cfgItem struct {
+	value string
+	file  string
+	line  int
+	from  string
+}
+
+//origin 配置项来源的描述,如 file E:\config\config.ini:12 或 env UPDATEPROGRAM_SOURCE_DIR
+func (item *cfgItem) origin(key string) string {
+	switch item.from {
+	case Cfg_From_File:
+		return "file " + item.file + ":" + strconv.Itoa(item.line)
+	case Cfg_From_Env:
+		return "env " + CfgEnvName(key)
+	case Cfg_From_Flag:
+		return "flag -" + key
+	}
+	return item.from
+}
+
+//cfgSection 配置节,file和line为节名所在的文件和行号
+type cfgSection struct {
+	file  string
+	line  int
+	items map[string]*cfgItem
+}
+
+//cfgSections 节名 + 配置节
+type cfgSections map[string]*cfgSection
+
+func (secs cfgSections) item(section, key string) *cfgItem {
+	if sec, ok := secs[section]; ok {
+		return sec.items[key]
+	}
+	return nil
+}
+
+func (secs cfgSections) line(section string) (string, int) {
+	if sec, ok := secs[section]; ok {
+		return sec.file, sec.line
+	}
+	return "", 0
+}
+
+//setItem 设置配置项,节不存在时创建
+func (secs cfgSections) setItem(section, key string, item *cfgItem) {
+	if _, ok := secs[section]; !ok {
+		secs[section] = &cfgSection{file: item.file, line: item.line, items: make(map[string]*cfgItem, 0)}
+	}
+	secs[section].items[key] = item
+}
+
+//merge 把other中的节和配置项合并进来,同名的配置项使用other中的
+func (secs cfgSections) merge(other cfgSections) {
+	for name, sec := range other {
+		if _, ok := secs[name]; !ok {
+			secs[name] = &cfgSection{file: sec.file, line: sec.line, items: make(map[string]*cfgItem, len(sec.items))}
 		}
-		if sec.HasKey("source_exe_name") {
-			upcfg.source_exe_name = sec.Key("source_exe_name").String()
+		for key, item := range sec.items {
+			secs[name].items[key] = item
 		}
-		if sec.HasKey("target_dir") {
-			upcfg.target_dir = sec.Key("target_dir").String()
+	}
+}
+
+//named 获取节名以prefix开头的所有节(命名更新配置或组件)的名称
+func (secs cfgSections) named(prefix string) []string {
+	names := make([]string, 0)
+	for name := range secs {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, strings.TrimPrefix(name, prefix))
 		}
-		if sec.HasKey("source_file_suffix") {
-			upcfg.source_file_suffix = sec.Key("source_file_suffix").String()
+	}
+	sort.Strings(names)
+	return names
+}
+
+//mergeNamed 把[prefix+name](如[Profile:name])中的配置项覆盖到其所属的节中,返回合并后的新配置
+func (secs cfgSections) mergeNamed(prefix, name string) (cfgSections, error) {
+	profile, ok := secs[prefix+name]
+	if !ok {
+		kind := strings.ToLower(strings.TrimSuffix(prefix, ":"))
+		msg := kind + " not found, available " + kind + "s: " + strings.Join(secs.named(prefix), ",")
+		return nil, CfgIssues{{Section: prefix + name, Msg: msg}}
+	}
+
+	merged := make(cfgSections, len(secs))
+	merged.merge(secs)
+
+	//不认识的配置项由checkUnknownKeys报告
+	for key, item := range profile.items {
+		if spec := findCfgKeySpec(key); spec != nil {
+			merged.setItem(spec.section, key, item)
 		}
-		if sec.HasKey("server_type") {
-			upcfg.server_type = sec.Key("server_type").String()
+	}
+
+	return merged, nil
+}
+
+//loadIniSections 解析ini配置内容,同时记录每个节和配置项所在的行号
+func loadIniSections(data []byte) (cfgSections, error) {
+	cfg, err := ini.Load(data)
+	if err != nil {
+		return nil, err
+	}
+
+	lines, err := scanIniLines(data)
+	if err != nil {
+		return nil, err
+	}
+
+	sections := make(cfgSections, 0)
+	for _, sec := range cfg.Sections() {
+		if sec.Name() == ini.DefaultSection && len(sec.Keys()) == 0 {
+			continue
 		}
-		if sec.HasKey("server_prefix") {
-			upcfg.server_prefix = sec.Key("server_prefix").String()
+
+		items := make(map[string]*cfgItem, 0)
+		for _, key := range sec.Keys() {
+			items[key.Name()] = &cfgItem{value: key.String(), line: lines[sec.Name()+"."+key.Name()]}
 		}
-		if sec.HasKey("not_update_serverid") {
-			upcfg.not_update_serverid = sec.Key("not_update_serverid").String()
+		sections[sec.Name()] = &cfgSection{line: lines[sec.Name()], items: items}
+	}
+
+	return sections, nil
+}
+
+//scanIniLines 扫描ini内容得到行号 key为"节名"或"节名.键名",节名和键名的引号会被去掉(兼容toml)
+func scanIniLines(data []byte) (map[string]int, error) {
+	lines := make(map[string]int, 0)
+	section := ini.DefaultSection
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for num := 1; scanner.Scan(); num++ {
+		text := strings.TrimSpace(scanner.Text())
+		if len(text) == 0 || text[0] == '#' || text[0] == ';' {
+			continue
+		}
+
+		if text[0] == '[' {
+			if end := strings.Index(text, "]"); end > 0 {
+				section = strings.Trim(strings.TrimSpace(text[1:end]), `"'`)
+				if _, ok := lines[section]; !ok {
+					lines[section] = num
+				}
+			}
+			continue
 		}
-		if sec.HasKey("backup_file_num") {
-			upcfg.backup_file_num, _ = sec.Key("backup_file_num").Int()
+
+		if index := strings.IndexAny(text, "=:"); index > 0 {
+			lines[section+"."+strings.Trim(strings.TrimSpace(text[:index]), `"'`)] = num
 		}
-		if sec.HasKey("update_stop_flag") {
-			upcfg.update_stop_flag, _ = sec.Key("update_stop_flag").Int()
+	}
+
+	return lines, scanner.Err()
+}
+
+//cfgKeySpec 配置项的定义:所在节,默认值,校验方式以及对应的字段
+type cfgKeySpec struct {
+	section  string
+	key      string
+	def      string
+	required bool
+	check    func(value string) string //返回值不为空表示校验不通过的原因
+	set      func(upcfg *UpdateCfg, value string)
+}
+
+//validate 校验配置项的值,返回不通过的原因
+func (spec *cfgKeySpec) validate(value string) string {
+	if len(strings.TrimSpace(value)) == 0 {
+		if spec.required {
+			return "value is required"
 		}
+		return ""
+	}
+
+	if spec.check != nil {
+		return spec.check(value)
 	}
+	return ""
+}
 
+//findCfgKeySpec 根据配置项名称查找其定义
+func findCfgKeySpec(key string) *cfgKeySpec {
+	for i := range cfgKeySpecs {
+		if cfgKeySpecs[i].key == key {
+			return &cfgKeySpecs[i]
+		}
+	}
 	return nil
 }
+
+//cfgKeySpecs 所有支持的配置项
+var cfgKeySpecs = []cfgKeySpec{
+	{Section_Signature, "author", "", false, checkFileNamePart,
+		func(upcfg *UpdateCfg, v string) { upcfg.author = v }},
+	{Section_Signature, "exe_version", "", true, checkExeVersion,
+		func(upcfg *UpdateCfg, v string) { upcfg.exe_version = v }},
+	{Section_Update_Cfg, "source_dir", "", true, checkDirExists,
+		func(upcfg *UpdateCfg, v string) { upcfg.source_dir = v }},
+	{Section_Update_Cfg, "source_file_suffix", "", true, checkCommaList,
+		func(upcfg *UpdateCfg, v string) { upcfg.source_file_suffix = v }},
+	{Section_Update_Cfg, "source_exe_name", "", true, checkFileNamePart,
+		func(upcfg *UpdateCfg, v string) { upcfg.source_exe_name = v }},
+	{Section_Update_Cfg, "target_dir", "", false, checkEmptyOr(checkDirExists),
+		func(upcfg *UpdateCfg, v string) { upcfg.target_dir = v }},
+	{Section_Update_Cfg, "server_type", "", true, checkOneOf("4", "5"),
+		func(upcfg *UpdateCfg, v string) { upcfg.server_type = v }},
+	{Section_Update_Cfg, "target_layout", Layout_Default, false, checkTargetLayout,
+		func(upcfg *UpdateCfg, v string) { upcfg.target_layout = v }},
+	{Section_Update_Cfg, "inventory", "", false, checkInventory,
+		func(upcfg *UpdateCfg, v string) { upcfg.inventory = v }},
+	{Section_Update_Cfg, "server_prefix", "", true, checkFileNamePart,
+		func(upcfg *UpdateCfg, v string) { upcfg.server_prefix = v }},
+	{Section_Update_Cfg, "service_name", Name_Service_Default, false, checkNameTemplate,
+		func(upcfg *UpdateCfg, v string) { upcfg.service_name = v }},
+	{Section_Update_Cfg, "target_exe_name", Name_Exe_Default, false, checkNameTemplate,
+		func(upcfg *UpdateCfg, v string) { upcfg.target_exe_name = v }},
+	{Section_Update_Cfg, "display_name", Name_Display_Default, false, checkNameTemplate,
+		func(upcfg *UpdateCfg, v string) { upcfg.display_name = v }},
+	{Section_Update_Cfg, "update_serverid", "", false, checkSelector,
+		func(upcfg *UpdateCfg, v string) { upcfg.update_serverid = v }},
+	{Section_Update_Cfg, "not_update_serverid", "", false, checkSelector,
+		func(upcfg *UpdateCfg, v string) { upcfg.not_update_serverid = v }},
+	{Section_Update_Cfg, "update_order", Order_ServerID, false, checkOneOf(UpdateOrders...),
+		func(upcfg *UpdateCfg, v string) { upcfg.update_order = v }},
+	{Section_Update_Cfg, "update_priority", "", false, checkSelector,
+		func(upcfg *UpdateCfg, v string) { upcfg.update_priority = v }},
+	{Section_Update_Cfg, "backup_file_num", "3", false, checkIntMin(0),
+		func(upcfg *UpdateCfg, v string) { upcfg.backup_file_num, _ = strconv.Atoi(v) }},
+	{Section_Update_Cfg, "update_stop_flag", "0", false, checkOneOf("0", "1"),
+		func(upcfg *UpdateCfg, v string) { upcfg.update_stop_flag, _ = strconv.Atoi(v) }},
+	{Section_Update_Cfg, "update_parallel", "1", false, checkIntMin(1),
+		func(upcfg *UpdateCfg, v string) { upcfg.update_parallel, _ = strconv.Atoi(v) }},
+	{Section_Update_Cfg, "canary_serverid", "", false, checkSelector,
+		func(upcfg *UpdateCfg, v string) { upcfg.canary_serverid = v }},
+	{Section_Update_Cfg, "canary_count", "0", false, checkIntMin(0),
+		func(upcfg *UpdateCfg, v string) { upcfg.canary_count, _ = strconv.Atoi(v) }},
+	{Section_Update_Cfg, "batch_size", "0", false, checkIntMin(0),
+		func(upcfg *UpdateCfg, v string) { upcfg.batch_size, _ = strconv.Atoi(v) }},
+	{Section_Update_Cfg, "soak_time", "0s", false, checkDuration,
+		func(upcfg *UpdateCfg, v string) { upcfg.soak_time, _ = time.ParseDuration(v) }},
+	{Section_Update_Cfg, "health_check", "", false, nil,
+		func(upcfg *UpdateCfg, v string) { upcfg.health_check = v }},
+	{Section_Update_Cfg, Hook_Pre_Backup, "", false, nil,
+		func(upcfg *UpdateCfg, v string) { upcfg.hook_pre_backup = v }},
+	{Section_Update_Cfg, Hook_Post_Copy, "", false, nil,
+		func(upcfg *UpdateCfg, v string) { upcfg.hook_post_copy = v }},
+	{Section_Update_Cfg, Hook_Pre_Restart, "", false, nil,
+		func(upcfg *UpdateCfg, v string) { upcfg.hook_pre_restart = v }},
+	{Section_Update_Cfg, Hook_Post_Restart, "", false, nil,
+		func(upcfg *UpdateCfg, v string) { upcfg.hook_post_restart = v }},
+	{Section_Update_Cfg, Hook_On_Failure, "", false, nil,
+		func(upcfg *UpdateCfg, v string) { upcfg.hook_on_failure = v }},
+	{Section_Update_Cfg, "hook_timeout", "60s", false, checkDuration,
+		func(upcfg *UpdateCfg, v string) { upcfg.hook_timeout, _ = time.ParseDuration(v) }},
+	{Section_Update_Cfg, "components", "", false, checkEmptyOr(checkCommaList),
+		func(upcfg *UpdateCfg, v string) { upcfg.components = v }},
+}
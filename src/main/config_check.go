@@ -0,0 +1,276 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+)
+
+//CfgIssue 配置校验不通过的问题,Line为0表示无法定位到具体行,From表示配置项的来源
+type CfgIssue struct {
+	File    string
+	Line    int
+	From    string
+	Section string
+	Key     string
+	Msg     string
+}
+
+func (ci CfgIssue) String() string {
+	pos := "line -"
+	switch {
+	case ci.From == Cfg_From_Flag:
+		pos = "flag -" + ci.Key
+	case ci.From == Cfg_From_Env:
+		pos = "env " + CfgEnvName(ci.Key)
+	case ci.Line > 0:
+		pos = "line " + strconv.Itoa(ci.Line)
+		if len(ci.File) > 0 {
+			pos += " of " + ci.File
+		}
+	}
+
+	if len(ci.Key) == 0 {
+		return fmt.Sprintf("%s [%s] %s", pos, ci.Section, ci.Msg)
+	}
+	return fmt.Sprintf("%s [%s] %s: %s", pos, ci.Section, ci.Key, ci.Msg)
+}
+
+//CfgIssues 配置校验的所有问题,作为error返回
+type CfgIssues []CfgIssue
+
+func (cis CfgIssues) Error() string {
+	str := fmt.Sprintf("config invalid, %d problem(s):", len(cis))
+	for _, ci := range cis {
+		str += "\r\n" + ci.String()
+	}
+	return str
+}
+
+//Sort 按行号排序,无法定位行号的排在最后
+func (cis CfgIssues) Sort() {
+	sort.SliceStable(cis, func(i, j int) bool {
+		if cis[i].Line == 0 || cis[j].Line == 0 {
+			return cis[j].Line == 0 && cis[i].Line != 0
+		}
+		return cis[i].Line < cis[j].Line
+	})
+}
+
+//checkUnknownKeys 检查缺失的节以及不认识的配置项(一般是拼写错误),命名更新配置也会被检查
+func checkUnknownKeys(sections cfgSections) CfgIssues {
+	issues := make(CfgIssues, 0)
+	known := make(map[string]bool, 0)
+	for _, spec := range cfgKeySpecs {
+		known[spec.section] = true
+		known[spec.section+"."+spec.key] = true
+	}
+
+	for _, name := range []string{Section_Signature, Section_Update_Cfg} {
+		if _, ok := sections[name]; !ok {
+			issues = append(issues, CfgIssue{Section: name, Msg: "section is missing"})
+		}
+	}
+
+	for name, sec := range sections {
+		isProfile := strings.HasPrefix(name, Section_Profile_Prefix) || strings.HasPrefix(name, Section_Component_Prefix)
+		if !known[name] && !isProfile && name != Section_Default {
+			continue
+		}
+		for key, item := range sec.items {
+			//命名更新配置和组件中可以包含任意一个节的配置项
+			if isProfile && findCfgKeySpec(key) != nil {
+				continue
+			}
+			if !known[name+"."+key] {
+				issues = append(issues, CfgIssue{File: item.file, Line: item.line, Section: name, Key: key, Msg: "unknown key"})
+			}
+		}
+	}
+
+	return issues
+}
+
+//checkRelation 校验配置项之间的关联关系
+func (upcfg *UpdateCfg) checkRelation(sections cfgSections) CfgIssues {
+	issues := make(CfgIssues, 0)
+	issue := func(key, msg string) CfgIssue {
+		if item := sections.item(Section_Update_Cfg, key); item != nil {
+			return CfgIssue{item.file, item.line, item.from, Section_Update_Cfg, key, msg}
+		}
+		file, line := sections.line(Section_Update_Cfg)
+		return CfgIssue{file, line, Cfg_From_Default, Section_Update_Cfg, key, msg}
+	}
+
+	//更新逻辑依赖主程序以.exe结尾,并且主程序也必须在更新的文件类型中
+	if !strings.HasSuffix(upcfg.source_exe_name, ".exe") {
+		issues = append(issues, issue("source_exe_name", "must end with .exe"))
+	} else if !FileIsExisted(upcfg.source_dir + string(os.PathSeparator) + upcfg.source_exe_name) {
+		issues = append(issues, issue("source_exe_name", "file not found in source_dir "+upcfg.source_dir))
+	}
+
+	exeCovered := false
+	for _, suffix := range strings.Split(upcfg.source_file_suffix, ",") {
+		if strings.HasSuffix(upcfg.source_exe_name, strings.TrimSpace(suffix)) {
+			exeCovered = true
+			break
+		}
+	}
+	if !exeCovered {
+		issues = append(issues, issue("source_file_suffix", "does not match source_exe_name "+upcfg.source_exe_name))
+	}
+
+	//名称模板中只能使用固定的变量和目录布局中的变量(使用服务器清单时没有目录布局)
+	layoutVars := make([]string, 0)
+	if len(upcfg.inventory) == 0 {
+		for _, name := range unknownNameVars(upcfg.target_layout) {
+			layoutVars = append(layoutVars, strings.Trim(name, "{}"))
+		}
+	}
+	for _, key := range []string{"service_name", "target_exe_name", "display_name"} {
+		known := layoutVars
+		if key != "service_name" {
+			known = append([]string{"service_name"}, layoutVars...)
+		}
+		tpl := upcfg.sources[key].value
+		if unknown := unknownNameVars(tpl, known...); len(unknown) > 0 {
+			issues = append(issues, issue(key, "unknown variable "+strings.Join(unknown, ",")+", available: {"+strings.Join(append(nameTemplateVars, known...), "},{")+"}"))
+		}
+	}
+	if !strings.HasSuffix(upcfg.target_exe_name, ".exe") {
+		issues = append(issues, issue("target_exe_name", "must end with .exe"))
+	}
+
+	//按标签排序需要服务器清单
+	switch upcfg.update_order {
+	case Order_Priority:
+		if len(upcfg.update_priority) == 0 {
+			issues = append(issues, issue("update_priority", "is required when update_order is "+Order_Priority))
+		}
+	case Order_Tag, Order_Least_Critical:
+		if len(upcfg.inventory) == 0 {
+			issues = append(issues, issue("update_order", upcfg.update_order+" uses the tags of inventory, but inventory is empty"))
+		}
+	}
+
+	//金丝雀只能用一种方式指定,健康检查命令中只能使用固定的变量
+	if len(upcfg.canary_serverid) > 0 && upcfg.canary_count > 0 {
+		issues = append(issues, issue("canary_count", "can not be used with canary_serverid, set only one of them"))
+	}
+	if unknown := unknownVars(upcfg.health_check, healthCheckVars); len(unknown) > 0 {
+		issues = append(issues, issue("health_check", "unknown variable "+strings.Join(unknown, ",")+", available: {"+strings.Join(healthCheckVars, "},{")+"}"))
+	}
+	if upcfg.hook_timeout <= 0 {
+		issues = append(issues, issue("hook_timeout", "must be greater than 0"))
+	}
+
+	//没有清单时需要扫描target_dir,有清单时清单中的问题一起报告
+	if len(upcfg.inventory) == 0 {
+		if len(upcfg.target_dir) == 0 {
+			issues = append(issues, issue("target_dir", "is required when inventory is empty"))
+		}
+	} else if path := upcfg.inventoryPath(); !FileIsExisted(path) {
+		issues = append(issues, issue("inventory", "file not exists: "+path))
+	} else if _, err := LoadInventory(path); err != nil {
+		if cis, ok := err.(CfgIssues); ok {
+			issues = append(issues, cis...)
+		} else {
+			issues = append(issues, issue("inventory", err.Error()))
+		}
+	}
+
+	return issues
+}
+
+//checkExeVersion 版本号必须是a.b.c.d四段且每段都是0-65535的数字
+func checkExeVersion(value string) string {
+	parts := strings.Split(value, ".")
+	if len(parts) != 4 {
+		return "version must have four parts like 1.0.0.1"
+	}
+
+	for _, p := range parts {
+		if n, err := strconv.Atoi(p); err != nil || n < 0 || n > 65535 {
+			return "version part " + strconv.Quote(p) + " is not a number in 0-65535"
+		}
+	}
+	return ""
+}
+
+//checkDirExists 路径必须是已经存在的目录
+func checkDirExists(value string) string {
+	fi, err := os.Stat(value)
+	if err != nil {
+		return "directory not exists: " + value
+	}
+	if !fi.IsDir() {
+		return "not a directory: " + value
+	}
+	return ""
+}
+
+//checkCommaList 逗号隔开的列表,每一项都不能为空
+func checkCommaList(value string) string {
+	for i, v := range strings.Split(value, ",") {
+		if len(strings.TrimSpace(v)) == 0 {
+			return "item " + strconv.Itoa(i+1) + " of the comma separated list is empty"
+		}
+	}
+	return ""
+}
+
+//checkFileNamePart 会被用于拼接文件名或服务名,不能包含路径分隔符等非法字符
+func checkFileNamePart(value string) string {
+	if strings.ContainsAny(value, `\/:*?"<>|()`) {
+		return "must not contain any of \\ / : * ? \" < > | ( )"
+	}
+	return ""
+}
+
+//checkOneOf 取值只能是给定的其中一个
+func checkOneOf(values ...string) func(string) string {
+	return func(value string) string {
+		for _, v := range values {
+			if value == v {
+				return ""
+			}
+		}
+		return "value must be one of " + strings.Join(values, ",")
+	}
+}
+
+//checkEmptyOr 取值为空或者满足check
+func checkEmptyOr(check func(string) string) func(string) string {
+	return func(value string) string {
+		if len(value) == 0 {
+			return ""
+		}
+		return check(value)
+	}
+}
+
+//checkDuration 取值必须是不小于0的时长,如 30s 5m 1h30m
+func checkDuration(value string) string {
+	if d, err := time.ParseDuration(value); err != nil || d < 0 {
+		return "value must be a duration like 30s, 5m or 1h30m"
+	}
+	return ""
+}
+
+//checkIntMin 取值必须是不小于min的整数
+func checkIntMin(min int) func(string) string {
+	return func(value string) string {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return "value is not an integer"
+		}
+		if n < min {
+			return "value must be >= " + strconv.Itoa(min)
+		}
+		return ""
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"strings"
+
+)
+
+//applyComponents 按components的顺序为每个组件合并[Component:名称]并校验,组件中未配置的项继承当前配置
+//sections为合并启动参数和环境变量之前的配置,baseIssues中已经报告过的问题不再重复报告
+func (upcfg *UpdateCfg) applyComponents(sections cfgSections, baseIssues CfgIssues) CfgIssues {
+	issues := make(CfgIssues, 0)
+	upcfg.component_cfgs = nil
+	if len(upcfg.components) == 0 {
+		return issues
+	}
+
+	reported := make(map[string]bool, 0)
+	for _, ci := range baseIssues {
+		reported[ci.String()] = true
+	}
+
+	for _, name := range strings.Split(upcfg.components, ",") {
+		name = strings.TrimSpace(name)
+		merged, err := sections.mergeNamed(Section_Component_Prefix, name)
+		if err != nil {
+			issues = append(issues, err.(CfgIssues)...)
+			continue
+		}
+		merged.mergeOverrides(upcfg.overrides)
+
+		comp := &UpdateCfg{component: name, profile: upcfg.profile, overrides: upcfg.overrides,
+			path: upcfg.path, files: upcfg.files, encoding: upcfg.encoding, detected: upcfg.detected}
+		for _, ci := range comp.apply(merged) {
+			if reported[ci.String()] {
+				continue
+			}
+			ci.Section = Section_Component_Prefix + name
+			issues = append(issues, ci)
+		}
+		if len(comp.components) > 0 && comp.components != upcfg.components {
+			issues = append(issues, CfgIssue{Section: Section_Component_Prefix + name, Key: "components", Msg: "can not be set in a component"})
+		}
+		comp.components = ""
+		upcfg.component_cfgs = append(upcfg.component_cfgs, comp)
+	}
+
+	return issues
+}
+
+//Components 获取需要按顺序更新的配置,没有配置components时只有当前配置
+func (upcfg *UpdateCfg) Components() []*UpdateCfg {
+	upcfg.mu.RLock()
+	defer upcfg.mu.RUnlock()
+
+	if len(upcfg.component_cfgs) == 0 {
+		return []*UpdateCfg{upcfg}
+	}
+	return upcfg.component_cfgs
+}
+
+//Name 组件名称,不是组件时为空
+func (upcfg *UpdateCfg) Name() string {
+	upcfg.mu.RLock()
+	defer upcfg.mu.RUnlock()
+	return upcfg.component
+}
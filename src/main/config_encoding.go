@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/simplifiedchinese"
+	"golang.org/x/text/encoding/unicode"
+
+)
+
+//配置文件编码
+const (
+	Encoding_Auto     = "auto"      //根据BOM和内容自动检测
+	Encoding_UTF8     = "utf-8"     //无BOM的UTF-8
+	Encoding_UTF8_BOM = "utf-8-bom" //带BOM的UTF-8
+	Encoding_UTF16LE  = "utf-16le"  //带BOM的UTF-16LE(记事本另存为Unicode)
+	Encoding_UTF16BE  = "utf-16be"  //带BOM的UTF-16BE
+	Encoding_GBK      = "gbk"       //中文Windows下记事本默认的ANSI编码
+
+	//Encoding_Template 生成配置模板时默认使用的编码,与发布的config.ini保持一致
+	Encoding_Template = Encoding_GBK
+)
+
+var (
+	bomUTF8    = []byte{0xEF, 0xBB, 0xBF}
+	bomUTF16LE = []byte{0xFF, 0xFE}
+	bomUTF16BE = []byte{0xFE, 0xFF}
+)
+
+//CfgEncodings 支持的编码
+var CfgEncodings = []string{Encoding_Auto, Encoding_UTF8, Encoding_UTF8_BOM, Encoding_UTF16LE, Encoding_UTF16BE, Encoding_GBK}
+
+//getEncoding 获取编码对应的转换器,UTF-8无需转换返回nil
+func getEncoding(name string) (encoding.Encoding, error) {
+	switch strings.ToLower(name) {
+	case Encoding_UTF8:
+		return nil, nil
+	case Encoding_UTF8_BOM:
+		return unicode.UTF8BOM, nil
+	case Encoding_UTF16LE:
+		return unicode.UTF16(unicode.LittleEndian, unicode.ExpectBOM), nil
+	case Encoding_UTF16BE:
+		return unicode.UTF16(unicode.BigEndian, unicode.ExpectBOM), nil
+	case Encoding_GBK:
+		return simplifiedchinese.GBK, nil
+	}
+	return nil, fmt.Errorf("unknown encoding %s, must be one of %s", name, strings.Join(CfgEncodings, ","))
+}
+
+//DetectEncoding 检测内容的编码:有BOM时按BOM,是合法的UTF-8时按UTF-8,否则按GBK
+func DetectEncoding(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, bomUTF8):
+		return Encoding_UTF8_BOM
+	case bytes.HasPrefix(data, bomUTF16LE):
+		return Encoding_UTF16LE
+	case bytes.HasPrefix(data, bomUTF16BE):
+		return Encoding_UTF16BE
+	case utf8.Valid(data):
+		return Encoding_UTF8
+	}
+	return Encoding_GBK
+}
+
+//DecodeCfgData 把配置内容从指定编码转换为UTF-8,编码为空或auto时自动检测,返回实际使用的编码
+func DecodeCfgData(data []byte, name string) ([]byte, string, error) {
+	if len(name) == 0 || strings.ToLower(name) == Encoding_Auto {
+		name = DetectEncoding(data)
+	}
+	name = strings.ToLower(name)
+
+	enc, err := getEncoding(name)
+	if err != nil || enc == nil {
+		return data, name, err
+	}
+
+	utf8Data, err := enc.NewDecoder().Bytes(data)
+	return utf8Data, name, err
+}
+
+//EncodeCfgData 把UTF-8内容转换为指定编码,用于生成配置模板,编码为空或auto时使用Encoding_Template
+func EncodeCfgData(text, name string) ([]byte, error) {
+	if len(name) == 0 || strings.ToLower(name) == Encoding_Auto {
+		name = Encoding_Template
+	}
+
+	enc, err := getEncoding(name)
+	if err != nil || enc == nil {
+		return []byte(text), err
+	}
+	return enc.NewEncoder().Bytes([]byte(text))
+}
+
+//checkEncoding 校验编码名称
+func checkEncoding(value string) string {
+	if strings.ToLower(value) == Encoding_Auto {
+		return ""
+	}
+	if _, err := getEncoding(value); err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+//SetEncoding 设置配置文件的编码,为auto时加载时自动检测
+func (upcfg *UpdateCfg) SetEncoding(name string) {
+	upcfg.mu.Lock()
+	upcfg.encoding = name
+	upcfg.mu.Unlock()
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+
+)
+
+//CfgFileExts 支持的配置文件格式,按查找默认配置文件时的优先顺序排列
+var CfgFileExts = []string{".ini", ".json", ".yaml", ".yml", ".toml"}
+
+//loadCfgSections 按编码读取配置文件,再根据后缀选择对应的格式解析,无法识别的后缀按ini解析
+//各种格式的结构一致:第一层是节名,第二层是配置项,返回值detected为实际使用的编码
+func loadCfgSections(path, encoding string) (sections cfgSections, detected string, err error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, "", err
+	}
+
+	data, detected, err := DecodeCfgData(raw, encoding)
+	if err != nil {
+		return nil, "", fmt.Errorf("config %s decode as %s fail: %s", path, detected, err)
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		sections, err = loadJSONSections(path, data)
+	case ".yaml", ".yml":
+		sections, err = loadYAMLSections(path, data)
+	case ".toml":
+		sections, err = loadTOMLSections(path, data)
+	default:
+		sections, err = loadIniSections(data)
+	}
+	if issues, ok := err.(CfgIssues); ok {
+		for i := range issues {
+			issues[i].File = path
+		}
+	}
+	if err != nil {
+		return nil, detected, err
+	}
+
+	for _, sec := range sections {
+		sec.file = path
+		for _, item := range sec.items {
+			item.file, item.from = path, Cfg_From_File
+		}
+	}
+	return sections, detected, nil
+}
+
+//loadJSONSections 解析json配置内容,逐个token解析以便记录行号
+func loadJSONSections(path string, data []byte) (cfgSections, error) {
+	lineAt := func(offset int64) int {
+		return bytes.Count(data[:offset], []byte("\n")) + 1
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	expectDelim := func(delim json.Delim) error {
+		tok, err := dec.Token()
+		if err != nil {
+			return fmt.Errorf("json %s line %d: %s", path, lineAt(dec.InputOffset()), err)
+		}
+		if d, ok := tok.(json.Delim); !ok || d != delim {
+			return fmt.Errorf("json %s line %d: expect %s", path, lineAt(dec.InputOffset()), delim)
+		}
+		return nil
+	}
+
+	if err := expectDelim('{'); err != nil {
+		return nil, err
+	}
+
+	//peek 获取下一个值的第一个字符,用于区分节和最外层的配置项(如extends)
+	peek := func() byte {
+		for i := dec.InputOffset(); i < int64(len(data)); i++ {
+			if c := data[i]; !strings.ContainsRune(" \t\r\n:", rune(c)) {
+				return c
+			}
+		}
+		return 0
+	}
+
+	sections := make(cfgSections, 0)
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, fmt.Errorf("json %s line %d: %s", path, lineAt(dec.InputOffset()), err)
+		}
+		name, _ := tok.(string)
+		line := lineAt(dec.InputOffset())
+
+		//最外层不是对象的值放到DEFAULT节中
+		if peek() != '{' {
+			var raw interface{}
+			if err := dec.Decode(&raw); err != nil {
+				return nil, fmt.Errorf("json %s line %d: %s", path, line, err)
+			}
+			value, ok := cfgValueString(raw)
+			if !ok {
+				return nil, CfgIssues{{Line: line, Section: Section_Default, Key: name, Msg: "value must be a string, number, bool or list"}}
+			}
+			sections.setItem(Section_Default, name, &cfgItem{value: value, line: line})
+			continue
+		}
+
+		sec := &cfgSection{line: line, items: make(map[string]*cfgItem, 0)}
+		if err := expectDelim('{'); err != nil {
+			return nil, err
+		}
+
+		for dec.More() {
+			tok, err := dec.Token()
+			if err != nil {
+				return nil, fmt.Errorf("json %s line %d: %s", path, lineAt(dec.InputOffset()), err)
+			}
+			key, _ := tok.(string)
+			line := lineAt(dec.InputOffset())
+
+			var raw interface{}
+			if err := dec.Decode(&raw); err != nil {
+				return nil, fmt.Errorf("json %s line %d: %s", path, line, err)
+			}
+			value, ok := cfgValueString(raw)
+			if !ok {
+				return nil, CfgIssues{{Line: line, Section: name, Key: key, Msg: "value must be a string, number, bool or list"}}
+			}
+			sec.items[key] = &cfgItem{value: value, line: line}
+		}
+
+		if err := expectDelim('}'); err != nil {
+			return nil, err
+		}
+		sections[name] = sec
+	}
+
+	return sections, nil
+}
+
+//loadYAMLSections 解析yaml配置内容,行号取自yaml节点
+func loadYAMLSections(path string, data []byte) (cfgSections, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("yaml %s: %s", path, err)
+	}
+
+	sections := make(cfgSections, 0)
+	if len(doc.Content) == 0 {
+		return sections, nil
+	}
+
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("yaml %s line %d: top level must be a mapping of sections", path, root.Line)
+	}
+
+	//MappingNode的Content是键值节点交替排列的
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		name, body := root.Content[i].Value, root.Content[i+1]
+
+		//最外层不是映射的值放到DEFAULT节中
+		if body.Kind != yaml.MappingNode {
+			var raw interface{}
+			if err := body.Decode(&raw); err != nil {
+				return nil, fmt.Errorf("yaml %s line %d: %s", path, body.Line, err)
+			}
+			value, ok := cfgValueString(raw)
+			if !ok {
+				return nil, CfgIssues{{Line: body.Line, Section: Section_Default, Key: name, Msg: "value must be a string, number, bool or list"}}
+			}
+			sections.setItem(Section_Default, name, &cfgItem{value: value, line: root.Content[i].Line})
+			continue
+		}
+
+		sec := &cfgSection{line: root.Content[i].Line, items: make(map[string]*cfgItem, 0)}
+		for j := 0; j+1 < len(body.Content); j += 2 {
+			key, valueNode := body.Content[j].Value, body.Content[j+1]
+
+			var raw interface{}
+			if err := valueNode.Decode(&raw); err != nil {
+				return nil, fmt.Errorf("yaml %s line %d: %s", path, valueNode.Line, err)
+			}
+			value, ok := cfgValueString(raw)
+			if !ok {
+				return nil, CfgIssues{{Line: valueNode.Line, Section: name, Key: key, Msg: "value must be a string, number, bool or list"}}
+			}
+			sec.items[key] = &cfgItem{value: value, line: body.Content[j].Line}
+		}
+		sections[name] = sec
+	}
+
+	return sections, nil
+}
+
+//loadTOMLSections 解析toml配置内容,toml的表和键的写法与ini一致,行号通过scanIniLines获取
+//节名包含:时需要加引号,如["Profile:mt5-prod"]
+func loadTOMLSections(path string, data []byte) (cfgSections, error) {
+	var tables map[string]interface{}
+	if _, err := toml.Decode(string(data), &tables); err != nil {
+		return nil, fmt.Errorf("toml %s: %s", path, err)
+	}
+
+	lines, err := scanIniLines(data)
+	if err != nil {
+		return nil, err
+	}
+
+	sections := make(cfgSections, 0)
+	for name, body := range tables {
+		//最外层不是表的值放到DEFAULT节中
+		table, ok := body.(map[string]interface{})
+		if !ok {
+			value, ok := cfgValueString(body)
+			if !ok {
+				return nil, CfgIssues{{Line: lines[Section_Default+"."+name], Section: Section_Default, Key: name, Msg: "value must be a string, number, bool or list"}}
+			}
+			sections.setItem(Section_Default, name, &cfgItem{value: value, line: lines[Section_Default+"."+name]})
+			continue
+		}
+
+		sec := &cfgSection{line: lines[name], items: make(map[string]*cfgItem, 0)}
+		for key, raw := range table {
+			value, ok := cfgValueString(raw)
+			if !ok {
+				return nil, CfgIssues{{Line: lines[name+"."+key], Section: name, Key: key, Msg: "value must be a string, number, bool or list"}}
+			}
+			sec.items[key] = &cfgItem{value: value, line: lines[name+"."+key]}
+		}
+		sections[name] = sec
+	}
+
+	return sections, nil
+}
+
+//cfgValueString 把json/yaml/toml中的值转换成与ini一致的字符串
+//bool转换为1/0,列表使用逗号拼接(如source_file_suffix,not_update_serverid)
+func cfgValueString(raw interface{}) (string, bool) {
+	switch v := raw.(type) {
+	case nil:
+		return "", true
+	case string:
+		return v, true
+	case json.Number:
+		return v.String(), true
+	case int:
+		return strconv.Itoa(v), true
+	case int64:
+		return strconv.FormatInt(v, 10), true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case bool:
+		if v {
+			return "1", true
+		}
+		return "0", true
+	case []interface{}:
+		parts := make([]string, 0, len(v))
+		for _, item := range v {
+			if _, isList := item.([]interface{}); isList {
+				return "", false
+			}
+			str, ok := cfgValueString(item)
+			if !ok {
+				return "", false
+			}
+			parts = append(parts, str)
+		}
+		return strings.Join(parts, ","), true
+	}
+	return "", false
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+)
+
+//引用其他配置文件的指令,写在所有节之前(json/yaml/toml中为最外层的键),多个文件使用,号隔开,相对路径相对于当前配置文件所在的目录
+//优先级从低到高:extends的文件(按书写顺序) < 当前文件 < include的文件(按书写顺序) < 环境变量 < 启动参数
+const (
+	Directive_Extends = "extends" //继承的基础配置,当前文件只需写需要覆盖的配置项
+	Directive_Include = "include" //引入的配置,会覆盖当前文件中的同名配置项
+)
+
+//loadCfgTree 加载配置文件以及它extends和include的所有文件并按优先级合并
+//chain为当前的引用链,用于检测循环引用,返回值files为加载过的所有文件,detected为path实际使用的编码
+func loadCfgTree(path, encoding string, chain []string) (sections cfgSections, files []string, detected string, err error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	for _, p := range chain {
+		if strings.EqualFold(p, abs) {
+			return nil, nil, "", fmt.Errorf("config include cycle: %s -> %s", strings.Join(chain, " -> "), abs)
+		}
+	}
+	chain = append(chain, abs)
+
+	current, detected, err := loadCfgSections(path, encoding)
+	if err != nil {
+		return nil, nil, detected, err
+	}
+	files = []string{path}
+
+	subs := make(map[string][]cfgSections, 0)
+	for _, directive := range []string{Directive_Extends, Directive_Include} {
+		item := current.item(Section_Default, directive)
+		if item == nil {
+			continue
+		}
+		delete(current[Section_Default].items, directive)
+
+		for _, sub := range strings.Split(item.value, ",") {
+			sub = strings.TrimSpace(sub)
+			if len(sub) == 0 {
+				continue
+			}
+			if !filepath.IsAbs(sub) {
+				sub = filepath.Join(filepath.Dir(path), sub)
+			}
+			if !FileIsExisted(sub) {
+				return nil, nil, detected, CfgIssues{{File: item.file, Line: item.line, Section: Section_Default, Key: directive, Msg: "file " + sub + " not exists"}}
+			}
+
+			secs, subFiles, _, err := loadCfgTree(sub, encoding, chain)
+			if err != nil {
+				return nil, nil, detected, err
+			}
+			subs[directive] = append(subs[directive], secs)
+			files = appendNew(files, subFiles...)
+		}
+	}
+	if sec, ok := current[Section_Default]; ok && len(sec.items) == 0 {
+		delete(current, Section_Default)
+	}
+
+	sections = make(cfgSections, 0)
+	for _, secs := range subs[Directive_Extends] {
+		sections.merge(secs)
+	}
+	sections.merge(current)
+	for _, secs := range subs[Directive_Include] {
+		sections.merge(secs)
+	}
+	return sections, files, detected, nil
+}
+
+//appendNew 追加list中没有的元素,同一个文件被多次引用时只记录一次
+func appendNew(list []string, items ...string) []string {
+	for _, item := range items {
+		found := false
+		for _, v := range list {
+			if v == item {
+				found = true
+				break
+			}
+		}
+		if !found {
+			list = append(list, item)
+		}
+	}
+	return list
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"strings"
+
+)
+
+//Cfg_Env_Prefix 覆盖配置项的环境变量前缀,如UPDATEPROGRAM_SOURCE_DIR
+const Cfg_Env_Prefix = "UPDATEPROGRAM_"
+
+//CfgEnvName 获取配置项对应的环境变量名称
+func CfgEnvName(key string) string {
+	return Cfg_Env_Prefix + strings.ToUpper(key)
+}
+
+//RegisterCfgFlags 为每个配置项注册同名的启动参数,如 -source_dir=E:\source
+func RegisterCfgFlags(fs *flag.FlagSet) {
+	for _, spec := range cfgKeySpecs {
+		usage := "override [" + spec.section + "] " + spec.key + ", env " + CfgEnvName(spec.key)
+		fs.String(spec.key, "", usage)
+	}
+}
+
+//CfgOverrides 收集启动参数和环境变量中的配置项,fs需要已经Parse过
+//优先级:启动参数 > 环境变量 > 配置文件 > 默认值,显式设置为空也会覆盖
+func CfgOverrides(fs *flag.FlagSet) map[string]*cfgItem {
+	overrides := make(map[string]*cfgItem, 0)
+	for _, spec := range cfgKeySpecs {
+		if value, ok := os.LookupEnv(CfgEnvName(spec.key)); ok {
+			overrides[spec.key] = &cfgItem{value: value, from: Cfg_From_Env}
+		}
+	}
+
+	fs.Visit(func(f *flag.Flag) {
+		if findCfgKeySpec(f.Name) != nil {
+			overrides[f.Name] = &cfgItem{value: f.Value.String(), from: Cfg_From_Flag}
+		}
+	})
+
+	return overrides
+}
+
+//SetOverrides 设置加载配置文件后需要覆盖的配置项
+func (upcfg *UpdateCfg) SetOverrides(overrides map[string]*cfgItem) {
+	upcfg.mu.Lock()
+	upcfg.overrides = overrides
+	upcfg.mu.Unlock()
+}
+
+//mergeOverrides 把覆盖的配置项合并到其所属的节中
+func (secs cfgSections) mergeOverrides(overrides map[string]*cfgItem) {
+	for key, item := range overrides {
+		if spec := findCfgKeySpec(key); spec != nil {
+			secs.setItem(spec.section, key, item)
+		}
+	}
+}
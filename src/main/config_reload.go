@@ -0,0 +1,126 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"time"
+
+)
+
+//CfgChange 重新加载前后值发生变化的配置项
+type CfgChange struct {
+	Key    string
+	Old    string
+	New    string
+	Origin string //新值的来源
+}
+
+func (cc CfgChange) String() string {
+	return cc.Key + ": " + cc.Old + " -> " + cc.New + " (" + cc.Origin + ")"
+}
+
+//Reload 按当前的配置文件,命名更新配置,编码和覆盖参数重新加载配置
+//新配置校验通过后才在锁内整体替换当前配置并返回变化的配置项,校验不通过时保留当前配置并返回错误
+func (upcfg *UpdateCfg) Reload() ([]CfgChange, error) {
+	upcfg.mu.RLock()
+	next := &UpdateCfg{encoding: upcfg.encoding, overrides: upcfg.overrides}
+	path, profile := upcfg.path, upcfg.profile
+	upcfg.mu.RUnlock()
+
+	if err := next.LoadProfile(path, profile); err != nil {
+		return nil, err
+	}
+
+	upcfg.mu.Lock()
+	defer upcfg.mu.Unlock()
+
+	changes := diffCfgSources("", upcfg.sources, next.sources)
+	before := make(map[string]*UpdateCfg, 0)
+	for _, comp := range upcfg.component_cfgs {
+		before[comp.component] = comp
+	}
+	for _, comp := range next.component_cfgs {
+		old := make(map[string]*cfgItem, 0)
+		if b, ok := before[comp.component]; ok {
+			old = b.sources
+		}
+		changes = append(changes, diffCfgSources(comp.component+".", old, comp.sources)...)
+	}
+
+	for _, spec := range cfgKeySpecs {
+		if source, ok := next.sources[spec.key]; ok {
+			spec.set(upcfg, source.value)
+		}
+	}
+	upcfg.component_cfgs = next.component_cfgs
+	upcfg.sources = next.sources
+	upcfg.files = next.files
+	upcfg.detected = next.detected
+
+	return changes, nil
+}
+
+//diffCfgSources 比较两次加载的配置项,prefix为组件名称前缀
+func diffCfgSources(prefix string, before, after map[string]*cfgItem) []CfgChange {
+	changes := make([]CfgChange, 0)
+	for _, spec := range cfgKeySpecs {
+		b, a := before[spec.key], after[spec.key]
+		if b == nil || a == nil || b.value != a.value {
+			change := CfgChange{Key: prefix + spec.key}
+			if b != nil {
+				change.Old = b.value
+			}
+			if a != nil {
+				change.New, change.Origin = a.value, a.origin(spec.key)
+			}
+			changes = append(changes, change)
+		}
+	}
+	return changes
+}
+
+//CfgWatcher 通过定时比较修改时间和大小监测配置文件(包括extends和include的文件)是否变化
+type CfgWatcher struct {
+	upcfg *UpdateCfg
+	stats map[string]string //文件路径 + 修改时间和大小,文件不存在时为空
+}
+
+func NewCfgWatcher(upcfg *UpdateCfg) *CfgWatcher {
+	cw := &CfgWatcher{upcfg: upcfg}
+	cw.stats = cw.snapshot()
+	return cw
+}
+
+//snapshot 获取当前配置涉及的所有文件的状态
+func (cw *CfgWatcher) snapshot() map[string]string {
+	cw.upcfg.mu.RLock()
+	files := append([]string{cw.upcfg.path}, cw.upcfg.files...)
+	cw.upcfg.mu.RUnlock()
+
+	stats := make(map[string]string, 0)
+	for _, file := range files {
+		stats[file] = ""
+		if fi, err := os.Stat(file); err == nil {
+			stats[file] = fi.ModTime().Format(time.RFC3339Nano) + " " + strconv.FormatInt(fi.Size(), 10)
+		}
+	}
+	return stats
+}
+
+//Reset 重新记录文件状态,重新加载后extends和include的文件可能发生变化
+func (cw *CfgWatcher) Reset() {
+	cw.stats = cw.snapshot()
+}
+
+//Changed 判断自上次调用以来是否有文件发生变化
+func (cw *CfgWatcher) Changed() bool {
+	stats := cw.snapshot()
+	changed := len(stats) != len(cw.stats)
+	for file, stat := range stats {
+		if cw.stats[file] != stat {
+			changed = true
+		}
+	}
+	cw.stats = stats
+	return changed
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+)
+
+//cfgTemplateDefaults 生成配置模板时未指定的配置项使用的值
+var cfgTemplateDefaults = map[string]string{
+	"author":           "jarlen",
+	"exe_version":      "1.0.0.1",
+	"update_stop_flag": "0",
+	"target_layout":    Layout_Default,
+}
+
+//cfgTemplateComments 每个节前面的注释说明
+var cfgTemplateComments = map[string]string{
+	Section_Signature: "#[Signature] 签名配置信息(author用于记录更新人,exe_version表示服务需升级到的版本用于判断服务是否更新成功)\r\n",
+
+	Section_Update_Cfg: "#[Update_Cfg] 更新配置\r\n" +
+		"##source_dir 源目录(更新文件的来源配合 source_file_suffix 使用表示具体更新该目录下的哪些类型的文件)\r\n" +
+		"#source_exe_name 源目录下的主程序文件名称\r\n" +
+		"#target_dir 更新到的目标目录（程序会遍历该目录获取所有的ServerID目录）再具体配合server_type 和 server_prefix 结合拼接成所有所有要更新的子服务目录\r\n" +
+		"#server_type 取值4或者5（代表是更新该serverid的mt5类型还是mt4类型）\r\n" +
+		"#target_layout 目标目录布局,用/或\\分隔每一级目录,每一级可以使用通配符*和?以及变量{名称},{target_dir}和{server_type}替换为对应配置项的值\r\n" +
+		"#其它变量匹配任意目录名并作为目标的变量,必须包含{server_id},同一个serverID匹配到多个目录时跳过,例如 {target_dir}/{region}/{server_id}\r\n" +
+		"#server_prefix 要更新的服务名称的前缀\r\n" +
+		"#service_name target_exe_name display_name 服务名,目标exe文件名和显示名(用于日志和更新结果)的模板,默认为 {server_prefix}{server_id} {service_name}.exe {service_name}\r\n" +
+		"#模板中可以使用变量{server_id},{server_type},{server_prefix},{target_dir},{dir_name}(目标目录名)以及target_layout中的变量,exe名和显示名还可以使用{service_name}\r\n" +
+		"#inventory 服务器清单文件(.csv或.json),不为空时使用清单中的服务器代替扫描target_dir,相对路径相对于本文件所在的目录\r\n" +
+		"#csv第一行为列名:server_id,dir,service,exe,tags(server_id和dir必填,service和exe为空时按service_name和target_exe_name生成,多个tag用;号隔开)\r\n" +
+		"#json为对象数组:[{\"server_id\":\"1001\",\"dir\":\"E:\\\\trade\\\\1001\\\\MT5\",\"tags\":[\"canary\"]}]\r\n" +
+		"#update_serverid 表示需要更新的serverID（使用,号隔开）,为空则表示全部都更新\r\n" +
+		"#not_update_serverid 表示无需更新的serverID（使用,号隔开）,优先于update_serverid\r\n" +
+		"#update_serverid和not_update_serverid的每一项都与serverID目录名完全匹配,支持:精确ID如1001,通配符如10*,正则如re:10\\d{2},数字范围如1000-1999\r\n" +
+		"#update_order 更新顺序:serverid按serverID排序(默认),priority按update_priority中选择条件的书写顺序优先更新,\r\n" +
+		"#tag按服务器清单中priority=N标签的N从小到大,least_critical按服务器清单中critical=N标签(critical等同于critical=9)从不重要到重要\r\n" +
+		"#update_priority update_order为priority时优先更新的serverID(使用,号隔开,支持的写法同update_serverid),如 2001,10*\r\n" +
+		"#backup_file_num 最多保留的备份的个数,多余并且最旧的会被清理掉\r\n" +
+		"#update_stop_flag更新停止标识是否启用（等于1启用:当更新到某个服务并且重启失败时就停止后续的更新，为0不启用）默认是0\r\n" +
+		"#update_parallel 同时更新的目标个数,默认是1(按update_order逐个更新),大于1时按update_order的顺序开始更新,需要停止时正在更新的目标会继续完成\r\n" +
+		"#canary_serverid canary_count 分阶段更新时第一个阶段(金丝雀)更新的目标:canary_serverid为serverID(写法同update_serverid),canary_count为按更新顺序的前N个,二选一,没有选中任何目标或选中了所有目标时不更新\r\n" +
+		"#batch_size 金丝雀之后每个阶段更新的目标个数,为0则剩下的一次更新;都不配置时不分阶段\r\n" +
+		"#soak_time 每个阶段更新结束后等待的时长(如 30s 5m),然后进行健康检查:已更新的服务都在运行并且exe版本号为exe_version,不通过则停止后续的阶段\r\n" +
+		"#health_check 健康检查时对每个已更新的目标额外执行的命令(通过cmd /C执行,60秒超时),退出码不为0表示不通过,可以使用变量{server_id},{service_name},{display_name},{server_dir},{target_exe},{exe_version}\r\n" +
+		"#hook_pre_backup hook_post_copy hook_pre_restart hook_post_restart 更新每个目标时在备份前,拷贝后(校验版本号前),重启服务前,重启服务成功后执行的命令(通过cmd /C执行),如清理缓存,写入配置标记\r\n" +
+		"#钩子退出码不为0或超时表示失败,与重启失败一样回滚该目标并按update_stop_flag决定是否停止后续的更新\r\n" +
+		"#hook_on_failure 目标更新失败并回滚之后执行的命令,退出码只记录到日志;hook_timeout 钩子命令的超时时间,默认是60s\r\n" +
+		"#钩子命令可以使用环境变量 UPDATE_HOOK UPDATE_SERVER_ID UPDATE_TARGET_DIR UPDATE_TARGET_EXE UPDATE_SERVICE_NAME UPDATE_DISPLAY_NAME UPDATE_OLD_VERSION UPDATE_NEW_VERSION,hook_on_failure还有UPDATE_ERROR\r\n" +
+		"#components 一次更新多个组件(如同时更新mt4和mt5),按书写顺序更新[Component:名称]中的组件(使用,号隔开),为空则只更新本配置\r\n",
+}
+
+//CfgTemplate 生成带注释的ini配置内容,values中没有的配置项使用cfgTemplateDefaults,都没有的留空
+func CfgTemplate(values map[string]string) string {
+	content := "#配置文件编码会根据BOM和内容自动检测(UTF-8/UTF-16/GBK),也可以通过启动参数 -encoding 指定\r\n" +
+		"#每个配置项都可以通过同名的启动参数(如 -source_dir=)或环境变量(如 UPDATEPROGRAM_SOURCE_DIR)覆盖,优先级:启动参数>环境变量>配置文件>默认值\r\n" +
+		"#在所有节之前可以写 extends=基础配置文件 继承共用的配置,本文件只写需要覆盖的配置项;include=配置文件 引入的配置会覆盖本文件的同名配置项\r\n" +
+		"#多个文件使用,号隔开,相对路径相对于本文件所在的目录,优先级:include的文件>本文件>extends的文件\r\n" +
+		"#extends=site_base.ini\r\n\r\n"
+
+	section := ""
+	for _, spec := range cfgKeySpecs {
+		if spec.section != section {
+			if len(section) > 0 {
+				content += "\r\n"
+			}
+			section = spec.section
+			content += cfgTemplateComments[section] + "[" + section + "]\r\n"
+		}
+
+		value, ok := values[spec.key]
+		if !ok {
+			value = cfgTemplateDefaults[spec.key]
+		}
+		content += spec.key + "=" + value + "\r\n"
+	}
+
+	content += "\r\n#[Profile:名称] 命名的更新配置,可包含[Signature]和[Update_Cfg]中的任意配置项,未配置的项继承[Signature]和[Update_Cfg]的值\r\n" +
+		"#启动时通过 -profile 名称 选择使用哪个更新配置,例如:\r\n" +
+		"#[Profile:mt4-prod]\r\n#server_type=4\r\n#server_prefix=TRADINGSYSTEM_MT4_\r\n" +
+		"\r\n#[Component:名称] 组件配置,可包含[Signature]和[Update_Cfg]中的任意配置项,未配置的项继承[Signature]和[Update_Cfg]的值\r\n" +
+		"#配置 components=mt4,mt5 后一次运行按顺序更新两个组件,更新结果合并在一起,例如:\r\n" +
+		"#[Component:mt4]\r\n#exe_version=1.0.0.1\r\n#server_type=4\r\n#server_prefix=TRADINGSYSTEM_MT4_\r\n" +
+		"#[Component:mt5]\r\n"
+
+	return content
+}
+
+//WriteCfgTemplate 按encoding编码把配置模板写入path,目录不存在时会创建
+func WriteCfgTemplate(path string, values map[string]string, encoding string) error {
+	data, err := EncodeCfgData(CfgTemplate(values), encoding)
+	if err != nil {
+		return err
+	}
+
+	if dir := filepath.Dir(path); !PathExists(dir) {
+		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+			return err
+		}
+	}
+	return ioutil.WriteFile(path, data, 0666)
+}
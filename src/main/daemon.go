@@ -0,0 +1,76 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+)
+
+//RunDaemon 常驻运行,定时检查配置文件是否变化,变化时重新加载并校验,新配置有问题时继续使用旧配置
+//默认只重新加载配置,启动时指定-auto_update才会在exe_version(包括组件的exe_version)变化时按新配置更新所有目标服务
+func RunDaemon(args []string) {
+	cf := NewCmdFlags(Cmd_Daemon)
+	interval := cf.Duration("interval", 5*time.Second, "how often to check the config files for changes")
+	atStart := cf.Bool("update_at_start", false, "also update once right after start")
+	autoUpdate := cf.Bool("auto_update", false, "update all targets when exe_version (or the exe_version of a component) changes, default only reload the config")
+	cf.Parse(args)
+
+	updateCfg, err := cf.LoadCfg()
+	if err != nil {
+		logU.ErrorDoo(err)
+		return
+	}
+	if *atStart {
+		UpdateAll(updateCfg)
+	}
+
+	watcher := NewCfgWatcher(updateCfg)
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, os.Interrupt)
+
+	logU.InfoDoo("Daemon start, checking config every", *interval, "auto_update:", *autoUpdate, "press Ctrl+C to stop")
+	for {
+		select {
+		case <-quit:
+			logU.InfoDoo("Daemon stop")
+			return
+		case <-ticker.C:
+		}
+
+		if !watcher.Changed() {
+			continue
+		}
+
+		changes, err := updateCfg.Reload()
+		if err != nil {
+			logU.ErrorDoo("Reload config fail, keep the current config:", err)
+			continue
+		}
+		watcher.Reset()
+
+		if len(changes) == 0 {
+			logU.InfoDoo("Reload config ok, no key changed")
+			continue
+		}
+		newVersion := false
+		str := "\r\n"
+		for _, change := range changes {
+			str += change.String() + "\r\n"
+			if change.Key == "exe_version" || strings.HasSuffix(change.Key, ".exe_version") {
+				newVersion = true
+			}
+		}
+		logU.InfoDoo("Reload config ok, changed keys:", str)
+
+		if newVersion && *autoUpdate {
+			logU.InfoDoo("exe_version changed, start update")
+			UpdateAll(updateCfg)
+		} else if newVersion {
+			logU.InfoDoo("exe_version changed, run \"UpdateProgram update\" to release it, the daemon only updates when started with -auto_update")
+		}
+	}
+}
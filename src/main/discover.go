@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+)
+
+//目标发现的结果
+const (
+	Discover_Selected    = "selected"             //需要更新
+	Discover_Excluded    = "excluded"             //被update_serverid和not_update_serverid过滤掉
+	Discover_No_Type_Dir = "no matching type dir" //serverID目录下没有与目录布局匹配的目录
+	Discover_Ambiguous   = "ambiguous"            //同一个serverID匹配到多个目录
+	Discover_Dir_Missing = "dir missing"          //服务器清单中的目录不存在
+)
+
+//Discovery 发现的一个serverID及其是否需要更新,Dir在没有匹配或匹配多个目录时为serverID所在的目录,此时Exe为空
+type Discovery struct {
+	ServerID string
+	Dir      string
+	Exe      string
+	Service  string
+	Display  string
+	Vars     map[string]string
+	Tags     []string
+	Status   string
+	Reason   string
+}
+
+//DiscoverTargets 按配置(服务器清单或目录布局)发现所有的serverID并给出是否需要更新及原因,调用方需持有upcfg的锁
+func DiscoverTargets(upcfg *UpdateCfg) ([]*Discovery, error) {
+	selector, err := NewTargetSelector(upcfg.update_serverid, upcfg.not_update_serverid)
+	if err != nil {
+		return nil, err
+	}
+	return DiscoverBy(upcfg, selector)
+}
+
+//DiscoverBy 按配置发现所有的serverID,由selector决定是否选中,调用方需持有upcfg的锁
+func DiscoverBy(upcfg *UpdateCfg, selector *TargetSelector) ([]*Discovery, error) {
+	if len(upcfg.inventory) > 0 {
+		return DiscoverInventory(upcfg.inventoryPath(), NewTargetNames(upcfg), selector)
+	}
+
+	layout, err := NewTargetLayout(upcfg.target_layout, upcfg.target_dir, upcfg.server_type)
+	if err != nil {
+		return nil, err
+	}
+	return DiscoverLayout(layout, NewTargetNames(upcfg), selector)
+}
+
+//DiscoverLayout 按目录布局发现serverID,selector为nil时全部选中,names为nil时不生成服务名和exe路径
+func DiscoverLayout(layout *TargetLayout, names *TargetNames, selector *TargetSelector) ([]*Discovery, error) {
+	PthSep := string(os.PathSeparator)
+
+	candidates, err := layout.ScanServerIDs()
+	if err != nil {
+		return nil, err
+	}
+	targets, err := layout.Scan()
+	if err != nil {
+		return nil, err
+	}
+
+	matched := make(map[string][]*Target, 0)
+	for _, t := range targets {
+		matched[t.ServerID] = append(matched[t.ServerID], t)
+	}
+
+	list := make([]*Discovery, 0, len(candidates))
+	seen := make(map[string]bool, 0)
+	for _, c := range candidates {
+		id := c.Vars[Layout_Server_ID]
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+
+		d := &Discovery{ServerID: id, Dir: c.Dir, Vars: c.Vars}
+		ok, reason := selector.Select(id)
+		switch ts := matched[id]; {
+		case !ok:
+			d.Status, d.Reason = Discover_Excluded, reason
+		case len(ts) == 0:
+			d.Status, d.Reason = Discover_No_Type_Dir, "no dir matches layout "+layout.Text
+		case len(ts) > 1:
+			dirs := make([]string, 0, len(ts))
+			for _, t := range ts {
+				dirs = append(dirs, t.Dir)
+			}
+			d.Status, d.Reason = Discover_Ambiguous, fmt.Sprintf("matches %d dirs: %s", len(ts), strings.Join(dirs, ", "))
+		default:
+			d.Status, d.Reason = Discover_Selected, reason
+			d.Dir, d.Vars = ts[0].Dir, ts[0].Vars
+		}
+		if names != nil {
+			exe := names.Resolve(d, "")
+			if d.Status == Discover_Selected {
+				d.Exe = d.Dir + PthSep + exe
+			}
+		}
+		list = append(list, d)
+	}
+
+	return list, nil
+}
+
+//DiscoverInventory 按服务器清单发现serverID,selector为nil时全部选中,清单中的目录不存在时不更新
+//清单中没有填写服务名和exe名时按names中的模板生成
+func DiscoverInventory(path string, names *TargetNames, selector *TargetSelector) ([]*Discovery, error) {
+	PthSep := string(os.PathSeparator)
+
+	entries, err := LoadInventory(path)
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]*Discovery, 0, len(entries))
+	for _, e := range entries {
+		d := &Discovery{ServerID: e.ServerID, Dir: e.Dir, Service: e.Service,
+			Vars: map[string]string{Layout_Server_ID: e.ServerID}, Tags: e.Tags}
+		d.Exe = e.Dir + PthSep + names.Resolve(d, e.Exe)
+
+		ok, reason := selector.Select(e.ServerID)
+		if fi, err := os.Stat(e.Dir); !ok {
+			d.Status, d.Reason = Discover_Excluded, reason
+		} else if err != nil || !fi.IsDir() {
+			d.Status, d.Reason = Discover_Dir_Missing, "dir in inventory "+path+" not exists"
+		} else {
+			d.Status, d.Reason = Discover_Selected, reason
+		}
+		list = append(list, d)
+	}
+
+	return list, nil
+}
+
+//RunDiscover 只执行发现更新目标的部分,打印每个serverID是否需要更新及原因
+func RunDiscover(args []string) {
+	cf := NewCmdFlags(Cmd_Discover)
+	cf.Parse(args)
+
+	updateCfg, err := cf.LoadCfg()
+	if err != nil {
+		logU.ErrorDoo(err)
+		return
+	}
+
+	for _, comp := range updateCfg.Components() {
+		if name := comp.Name(); len(name) > 0 {
+			fmt.Fprintf(os.Stdout, "\r\n==== component: %s ====\r\n", name)
+		}
+
+		comp.mu.RLock()
+		list, err := DiscoverTargets(comp)
+		comp.mu.RUnlock()
+		if err != nil {
+			logU.ErrorDoo("Discover targets fail:", err)
+			continue
+		}
+		PrintDiscovery(os.Stdout, list)
+	}
+}
+
+//PrintDiscovery 按表格输出发现的结果以及各状态的数量
+func PrintDiscovery(w io.Writer, list []*Discovery) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "serverID\tstatus\ttarget exe\tservice\tdisplay name\treason\r\n")
+	count := make(map[string]int, 0)
+	for _, d := range list {
+		exe := d.Exe
+		if len(exe) == 0 {
+			exe = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\r\n", d.ServerID, d.Status, exe, d.Service, d.Display, d.Reason)
+		count[d.Status]++
+	}
+	tw.Flush()
+
+	summary := make([]string, 0)
+	for _, status := range []string{Discover_Selected, Discover_Excluded, Discover_No_Type_Dir, Discover_Ambiguous, Discover_Dir_Missing} {
+		if count[status] > 0 {
+			summary = append(summary, fmt.Sprintf("%s %d", status, count[status]))
+		}
+	}
+	fmt.Fprintf(w, "\r\ntotal %d: %s\r\n", len(list), strings.Join(summary, ", "))
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/chai2010/winsvc"
+
+)
+
+//RunExplain 打印最终生效的配置以及根据配置推导出的更新目标,并标明每个值的来源
+func RunExplain(args []string) {
+	cf := NewCmdFlags(Cmd_Explain)
+	cf.Parse(args)
+
+	updateCfg, err := cf.LoadCfg()
+	if err != nil {
+		logU.ErrorDoo(err)
+		return
+	}
+
+	//配置了components时按更新顺序逐个输出每个组件
+	for i, comp := range updateCfg.Components() {
+		if i > 0 {
+			fmt.Fprintf(os.Stdout, "\r\n")
+		}
+		updateProgram := NewUpdateProgram()
+		updateProgram.Load(comp)
+		ExplainCfg(os.Stdout, comp, updateProgram)
+	}
+}
+
+//ExplainCfg 输出配置项及推导出的UpdateProgram状态,推导的结果可能有问题时给出WARN提示
+func ExplainCfg(w io.Writer, upcfg *UpdateCfg, up *UpdateProgram) {
+	upcfg.mu.RLock()
+	defer upcfg.mu.RUnlock()
+
+	if len(upcfg.component) > 0 {
+		fmt.Fprintf(w, "==== component: %s ====\r\n", upcfg.component)
+	}
+	fmt.Fprintf(w, "config: %s\r\nprofile: %s\r\nencoding: %s (declared %s)\r\n", upcfg.path, upcfg.profile, upcfg.detected, upcfg.encoding)
+	if len(upcfg.files) > 1 {
+		fmt.Fprintf(w, "files (%s and %s): %s\r\n", Directive_Extends, Directive_Include, strings.Join(upcfg.files, ", "))
+	}
+	fmt.Fprintf(w, "\r\n")
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	section := ""
+	for _, spec := range cfgKeySpecs {
+		if spec.section != section {
+			section = spec.section
+			fmt.Fprintf(tw, "[%s]\t\t\r\n", section)
+		}
+		if source, ok := upcfg.sources[spec.key]; ok {
+			fmt.Fprintf(tw, "  %s\t= %s\t(%s)\r\n", spec.key, source.value, source.origin(spec.key))
+		}
+	}
+	tw.Flush()
+
+	warns := make([]string, 0)
+
+	//源文件 source_dir + source_file_suffix
+	fmt.Fprintf(w, "\r\nsource exe (%s: source_dir + source_exe_name):\r\n  %s\r\n", Cfg_From_Derived, up.source_exe_file)
+	fmt.Fprintf(w, "\r\nsource files (%s: source_dir + source_file_suffix):\r\n", Cfg_From_Derived)
+	names := sortedKeys(up.source_file)
+	for _, name := range names {
+		fmt.Fprintf(w, "  %s -> %s\r\n", name, up.source_file[name])
+	}
+
+	for _, suffix := range strings.Split(upcfg.source_file_suffix, ",") {
+		count := 0
+		for _, name := range names {
+			if strings.HasSuffix(name, suffix) {
+				count++
+			}
+		}
+		if count == 0 {
+			warns = append(warns, "source_file_suffix "+suffix+" matches no file in "+upcfg.source_dir)
+		}
+	}
+
+	//更新目标 target_layout(或inventory) + update_serverid + not_update_serverid,服务名,exe名和显示名按模板生成(或inventory中的值)
+	from := "target_layout + update_serverid + not_update_serverid, service_name + target_exe_name + display_name"
+	if len(upcfg.inventory) > 0 {
+		from = "inventory " + upcfg.inventoryPath() + " + update_serverid + not_update_serverid, service_name + target_exe_name + display_name"
+	}
+	fmt.Fprintf(w, "\r\ntargets in update order %s (%s: %s):\r\n", upcfg.update_order, Cfg_From_Derived, from)
+	ids := up.order
+
+	tw = tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "  serverID\ttarget dir\ttarget exe\tservice\tdisplay name\tservice status\tvariables\r\n")
+	for _, id := range ids {
+		service := up.target_service[id]
+		status, err := winsvc.QueryService(service)
+		if err != nil {
+			status = "not found"
+			warns = append(warns, "service "+service+" not found, please check service_name, target_exe_name or inventory")
+		}
+		exe := up.target_exe_file[id]
+		if !FileIsExisted(exe) {
+			warns = append(warns, "target exe "+exe+" not exists, please check service_name, target_exe_name or inventory")
+		}
+		vars := make([]string, 0)
+		for name, value := range up.target_vars[id] {
+			if name != Layout_Server_ID {
+				vars = append(vars, name+"="+value)
+			}
+		}
+		sort.Strings(vars)
+		fmt.Fprintf(tw, "  %s\t%s\t%s\t%s\t%s\t%s\t%s\r\n", id, up.target_dir[id], exe, service, up.target_display[id], status, strings.Join(vars, " "))
+	}
+	tw.Flush()
+
+	if len(ids) == 0 {
+		warns = append(warns, "no target found, please check target_dir, server_type and target_layout (or inventory)")
+	}
+
+	//精确的serverID在目录布局中不存在时一般是写错了
+	existing := make(map[string]bool, 0)
+	discovered, _ := DiscoverTargets(upcfg)
+	for _, d := range discovered {
+		existing[d.ServerID] = true
+	}
+	for i, list := range []string{upcfg.update_serverid, upcfg.not_update_serverid} {
+		key := []string{"update_serverid", "not_update_serverid"}[i]
+		terms, _ := ParseSelectorTerms(list)
+		for _, term := range terms {
+			if term.Kind == Term_Exact && !existing[term.Text] {
+				warns = append(warns, key+" "+term.Text+" is not a known serverID")
+			}
+		}
+	}
+
+	if len(warns) > 0 {
+		fmt.Fprintf(w, "\r\nwarnings:\r\n")
+		for _, warn := range warns {
+			fmt.Fprintf(w, "  WARN %s\r\n", warn)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+)
+
+//更新每个目标时执行钩子命令的时机,同时也是配置项的名字
+const (
+	Hook_Pre_Backup   = "hook_pre_backup"   //备份目标文件之前
+	Hook_Post_Copy    = "hook_post_copy"    //拷贝源文件并重命名主程序之后,校验版本号之前
+	Hook_Pre_Restart  = "hook_pre_restart"  //校验版本号之后,重启服务之前
+	Hook_Post_Restart = "hook_post_restart" //重启服务成功之后
+	Hook_On_Failure   = "hook_on_failure"   //更新失败并回滚之后,退出码只记录不影响结果
+)
+
+//HookNames 所有钩子,按执行的先后顺序
+var HookNames = []string{Hook_Pre_Backup, Hook_Post_Copy, Hook_Pre_Restart, Hook_Post_Restart, Hook_On_Failure}
+
+//钩子命令可以使用的环境变量
+const (
+	Hook_Env_Hook         = "UPDATE_HOOK"
+	Hook_Env_Server_ID    = "UPDATE_SERVER_ID"
+	Hook_Env_Target_Dir   = "UPDATE_TARGET_DIR"
+	Hook_Env_Target_Exe   = "UPDATE_TARGET_EXE"
+	Hook_Env_Service_Name = "UPDATE_SERVICE_NAME"
+	Hook_Env_Display_Name = "UPDATE_DISPLAY_NAME"
+	Hook_Env_Old_Version  = "UPDATE_OLD_VERSION"
+	Hook_Env_New_Version  = "UPDATE_NEW_VERSION"
+	Hook_Env_Error        = "UPDATE_ERROR" //只有hook_on_failure才有
+)
+
+//hookEnv 目标的钩子命令的环境变量,oldVersion为更新前目标exe的版本号
+func (up *UpdateProgram) hookEnv(k, oldVersion string) []string {
+	return []string{
+		Hook_Env_Server_ID + "=" + k,
+		Hook_Env_Target_Dir + "=" + up.target_dir[k],
+		Hook_Env_Target_Exe + "=" + up.target_exe_file[k],
+		Hook_Env_Service_Name + "=" + up.target_service[k],
+		Hook_Env_Display_Name + "=" + up.target_display[k],
+		Hook_Env_Old_Version + "=" + oldVersion,
+		Hook_Env_New_Version + "=" + up.exe_version,
+	}
+}
+
+//runHook 执行目标的钩子命令,没有配置时直接返回,退出码不为0或超时返回错误,预演时只记录
+func (up *UpdateProgram) runHook(k, hook string, env []string) error {
+	cmdline := up.hooks[hook]
+	if len(cmdline) == 0 {
+		return nil
+	}
+	up.record(k, Action_Hook, hook, "")
+	if up.dry_run {
+		return nil
+	}
+
+	env = append([]string{Hook_Env_Hook + "=" + hook}, env...)
+	err := up.do(k, Action_Hook, hook, "", func() error { return RunCommand(cmdline, env, up.hook_timeout) })
+	if err != nil {
+		return &updateError{Action_Hook, fmt.Errorf("%s %s", hook, err)}
+	}
+	up.log(k).InfoDooEx("hook", hook, "done:", cmdline)
+	return nil
+}
+
+//runFailureHook 更新失败并回滚之后执行hook_on_failure,失败只记录日志
+func (up *UpdateProgram) runFailureHook(k string, env []string, cause error) {
+	env = append(env, Hook_Env_Error+"="+strings.Replace(cause.Error(), "\n", " ", -1))
+	if err := up.runHook(k, Hook_On_Failure, env); err != nil {
+		up.log(k).ErrorDoo(err)
+	}
+}
+
+//exeVersion 目标exe当前的版本号,预演时不读取
+func (up *UpdateProgram) exeVersion(k string) string {
+	if up.dry_run {
+		return ""
+	}
+	fi := fileInfo{FilePath: up.target_exe_file[k]}
+	fi.GetExeVersion()
+	return fi.Version
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+)
+
+//RunInit 交互式生成配置文件,询问的同时扫描源目录和目标目录并展示发现的内容
+//启动参数中的配置项(如 -source_dir=)会作为对应问题的默认答案
+func RunInit(args []string) {
+	cf := NewCmdFlags(Cmd_Init)
+	cf.Parse(args)
+
+	if msg := checkEncoding(*cf.encoding); msg != "" {
+		logU.ErrorDoo("flag -encoding", msg)
+		return
+	}
+
+	cfgpath := *cf.config
+	if len(cfgpath) == 0 {
+		cfgpath = DefaultCfgPath()
+	}
+	if ext := strings.ToLower(filepath.Ext(cfgpath)); ext != ".ini" {
+		logU.ErrorDoo("init only writes .ini config, not", cfgpath)
+		return
+	}
+
+	wz := &initWizard{reader: bufio.NewReader(os.Stdin), out: os.Stdout, values: make(map[string]string, 0)}
+	for key, item := range CfgOverrides(cf.FlagSet) {
+		wz.values[key] = item.value
+	}
+
+	if PathExists(cfgpath) && !wz.confirm("config "+cfgpath+" already exists, overwrite it?", false) {
+		return
+	}
+
+	wz.askSource()
+	wz.askTarget()
+	wz.askKey("backup_file_num", "max backups to keep for each file", "3")
+	wz.askKey("update_stop_flag", "stop the whole update when a service fails to restart (1 yes, 0 no)", "0")
+	wz.askKey("update_parallel", "how many targets to update at the same time", "1")
+	if wz.eof {
+		logU.ErrorDoo("init abort: input closed")
+		return
+	}
+
+	if err := WriteCfgTemplate(cfgpath, wz.values, *cf.encoding); err != nil {
+		logU.ErrorDoo("write config", cfgpath, "fail:", err)
+		return
+	}
+	fmt.Fprintf(wz.out, "\r\nconfig written to %s\r\n", cfgpath)
+
+	//重新加载一遍确认写入的配置可以通过校验
+	updateCfg := NewUpdateCfg()
+	updateCfg.SetEncoding(*cf.encoding)
+	if err := updateCfg.Load(cfgpath); err != nil {
+		fmt.Fprintf(wz.out, "WARN the written config is invalid:\r\n%s\r\n", err)
+		return
+	}
+	fmt.Fprintf(wz.out, "config check ok, run \"UpdateProgram explain\" to review it\r\n")
+}
+
+//initWizard 交互式配置向导,values保存已经确定的配置项
+type initWizard struct {
+	reader *bufio.Reader
+	out    io.Writer
+	values map[string]string
+	eof    bool //输入已经结束,之后的问题都使用默认答案
+}
+
+//ask 询问直到答案通过check校验,直接回车使用默认答案
+func (wz *initWizard) ask(question, def string, check func(string) string) string {
+	for {
+		if len(def) > 0 {
+			fmt.Fprintf(wz.out, "%s [%s]: ", question, def)
+		} else {
+			fmt.Fprintf(wz.out, "%s: ", question)
+		}
+
+		if wz.eof {
+			fmt.Fprintln(wz.out)
+			return def
+		}
+
+		line, err := wz.reader.ReadString('\n')
+		if err != nil {
+			wz.eof = true
+		}
+
+		answer := strings.TrimSpace(line)
+		if len(answer) == 0 {
+			answer = def
+		}
+		if check == nil || wz.eof {
+			return answer
+		}
+		msg := check(answer)
+		if msg == "" {
+			return answer
+		}
+		fmt.Fprintf(wz.out, "  invalid: %s\r\n", msg)
+	}
+}
+
+//askKey 询问配置项的值并按配置项的定义校验,已有的值优先作为默认答案
+func (wz *initWizard) askKey(key, question, def string) string {
+	if value, ok := wz.values[key]; ok {
+		def = value
+	}
+
+	spec := findCfgKeySpec(key)
+	wz.values[key] = wz.ask(key+" ("+question+")", def, spec.validate)
+	return wz.values[key]
+}
+
+//confirm 询问是否确认
+func (wz *initWizard) confirm(question string, def bool) bool {
+	defAnswer := "n"
+	if def {
+		defAnswer = "y"
+	}
+	answer := wz.ask(question+" (y/n)", defAnswer, checkOneOf("y", "n", "Y", "N"))
+	return strings.ToLower(answer) == "y"
+}
+
+//askSource 询问源目录,并展示扫描到的需要更新的文件
+func (wz *initWizard) askSource() {
+	PthSep := string(os.PathSeparator)
+
+	sourceDir := wz.askKey("source_dir", "dir of the new version files", "")
+	suffix := wz.askKey("source_file_suffix", "file types to update, comma separated", "exe,dll,pdb")
+
+	files, _ := GetFiles(sourceDir, strings.Split(suffix, ","), true)
+	fmt.Fprintf(wz.out, "  found %d file(s) to update in %s:\r\n", len(files), sourceDir)
+	for _, f := range files {
+		fmt.Fprintf(wz.out, "    %s\r\n", f)
+	}
+
+	//源目录下只有一个exe时作为默认的主程序
+	exeDef := ""
+	if exes, _ := GetFiles(sourceDir, []string{".exe"}, false); len(exes) == 1 {
+		exeDef, _ = GetFileNameByPath(exes[0])
+	}
+	exeName := wz.ask("source_exe_name (main program file name in source_dir)", wz.valueOr("source_exe_name", exeDef), func(v string) string {
+		if msg := findCfgKeySpec("source_exe_name").validate(v); msg != "" {
+			return msg
+		}
+		if !FileIsExisted(sourceDir + PthSep + v) {
+			return "file not found in " + sourceDir
+		}
+		return ""
+	})
+	wz.values["source_exe_name"] = exeName
+
+	//默认使用源exe的版本号作为需要升级到的版本
+	fi := fileInfo{FilePath: sourceDir + PthSep + exeName}
+	fi.GetExeVersion()
+	fmt.Fprintf(wz.out, "  %s version: %s\r\n", exeName, fi.Version)
+	wz.askKey("exe_version", "version the services must have after update", fi.Version)
+	wz.askKey("author", "name recorded in the backup file names", wz.valueOr("author", os.Getenv("USERNAME")))
+}
+
+//askTarget 询问目标目录和类型,并展示发现的serverID目录,没有发现时可以重新输入
+func (wz *initWizard) askTarget() {
+	var dirmap map[string]string
+	for {
+		targetDir := wz.askKey("target_dir", "dir that contains all the serverID dirs", "")
+		serverType := wz.askKey("server_type", "4 for mt4, 5 for mt5", "5")
+
+		layoutText := wz.askKey("target_layout", "layout of the target dirs, {server_id} is the serverID", Layout_Default)
+		if layout, err := NewTargetLayout(layoutText, targetDir, serverType); err == nil {
+			dirmap, _, _ = GetCurDirList(layout, nil)
+		}
+		fmt.Fprintf(wz.out, "  found %d serverID dir(s) matching %s:\r\n", len(dirmap), layoutText)
+		for _, id := range sortedKeys(dirmap) {
+			fmt.Fprintf(wz.out, "    %s -> %s\r\n", id, dirmap[id])
+		}
+
+		if len(dirmap) > 0 || wz.eof || wz.confirm("no target found, keep these values anyway?", false) {
+			break
+		}
+	}
+
+	prefix := wz.askKey("server_prefix", "service name prefix, service name is prefix + serverID", guessServerPrefix(dirmap))
+	found := 0
+	for id, dir := range dirmap {
+		if FileIsExisted(dir + string(os.PathSeparator) + prefix + id + ".exe") {
+			found++
+		}
+	}
+	fmt.Fprintf(wz.out, "  %d of %d target(s) have the exe %s<serverID>.exe\r\n", found, len(dirmap), prefix)
+
+	include := wz.askKey("update_serverid", "serverIDs to update, empty for all", "")
+	exclude := wz.askKey("not_update_serverid", "serverIDs not to update", "")
+	if selector, err := NewTargetSelector(include, exclude); err == nil {
+		selected := 0
+		for id := range dirmap {
+			if ok, _ := selector.Select(id); ok {
+				selected++
+			}
+		}
+		fmt.Fprintf(wz.out, "  %d of %d target(s) selected\r\n", selected, len(dirmap))
+	}
+}
+
+//valueOr 已有配置项的值,没有时返回def
+func (wz *initWizard) valueOr(key, def string) string {
+	if value, ok := wz.values[key]; ok {
+		return value
+	}
+	return def
+}
+
+//guessServerPrefix 根据目标目录下 前缀+serverID.exe 的文件猜测服务名前缀
+func guessServerPrefix(dirmap map[string]string) string {
+	for _, id := range sortedKeys(dirmap) {
+		files, _ := GetFiles(dirmap[id], []string{id + ".exe"}, false)
+		for _, f := range files {
+			if name, err := GetFileNameByPath(f); err == nil {
+				if prefix := strings.TrimSuffix(name, id+".exe"); len(prefix) > 0 {
+					return prefix
+				}
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+)
+
+//Inventory_Columns csv清单的列名,第一行必须是列名,server_id和dir必填,tags中多个标签使用;号隔开
+var Inventory_Columns = []string{"server_id", "dir", "service", "exe", "tags"}
+
+//InventoryEntry 清单中的一个更新目标,service和exe为空时按service_name和target_exe_name模板生成
+type InventoryEntry struct {
+	ServerID string   `json:"server_id"`
+	Dir      string   `json:"dir"`
+	Service  string   `json:"service"`
+	Exe      string   `json:"exe"`
+	Tags     []string `json:"tags"`
+	line     int
+}
+
+//LoadInventory 读取csv或json格式的服务器清单,按行号返回所有的问题
+//json格式为对象数组,如 [{"server_id":"1001","dir":"E:\\trade\\1001\\MT5","tags":["canary"]}]
+func LoadInventory(path string) ([]*InventoryEntry, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	data, _, err := DecodeCfgData(raw, Encoding_Auto)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []*InventoryEntry
+	if strings.ToLower(filepath.Ext(path)) == ".json" {
+		entries, err = loadInventoryJSON(data)
+	} else {
+		entries, err = loadInventoryCSV(data)
+	}
+	if err != nil {
+		return nil, CfgIssues{{File: path, Section: "inventory", Msg: err.Error()}}
+	}
+
+	issues := make(CfgIssues, 0)
+	seen := make(map[string]int, 0)
+	for _, e := range entries {
+		issue := func(key, msg string) {
+			issues = append(issues, CfgIssue{File: path, Line: e.line, Section: "inventory", Key: key, Msg: msg})
+		}
+		if len(e.ServerID) == 0 {
+			issue("server_id", "is empty")
+		} else if line, ok := seen[e.ServerID]; ok {
+			issue("server_id", e.ServerID+" is duplicated with line "+strconv.Itoa(line))
+		} else if msg := checkFileNamePart(e.ServerID); msg != "" {
+			issue("server_id", msg)
+		}
+		seen[e.ServerID] = e.line
+		if len(e.Dir) == 0 {
+			issue("dir", "is empty")
+		}
+		if len(e.Exe) > 0 {
+			if !strings.HasSuffix(e.Exe, ".exe") {
+				issue("exe", "must end with .exe")
+			}
+			if msg := checkFileNamePart(e.Exe); msg != "" {
+				issue("exe", msg)
+			}
+		}
+	}
+
+	if len(issues) > 0 {
+		return nil, issues
+	}
+	return entries, nil
+}
+
+//loadInventoryCSV 解析csv清单,#开头的行为注释
+func loadInventoryCSV(data []byte) ([]*InventoryEntry, error) {
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, err
+	}
+	columns := make(map[string]int, 0)
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, name := range Inventory_Columns[:2] {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("first line must be the column names, column %s is missing, columns: %s", name, strings.Join(Inventory_Columns, ","))
+		}
+	}
+
+	entries := make([]*InventoryEntry, 0)
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		line, _ := reader.FieldPos(0)
+		field := func(name string) string {
+			if i, ok := columns[name]; ok && i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+
+		e := &InventoryEntry{ServerID: field("server_id"), Dir: field("dir"), Service: field("service"), Exe: field("exe"), line: line}
+		for _, tag := range strings.Split(field("tags"), ";") {
+			if tag = strings.TrimSpace(tag); len(tag) > 0 {
+				e.Tags = append(e.Tags, tag)
+			}
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+//loadInventoryJSON 解析json清单,行号为每个对象开始的行
+func loadInventoryJSON(data []byte) ([]*InventoryEntry, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if tok, err := dec.Token(); err != nil {
+		return nil, err
+	} else if tok != json.Delim('[') {
+		return nil, fmt.Errorf("must be an array of objects")
+	}
+
+	entries := make([]*InventoryEntry, 0)
+	for dec.More() {
+		start := dec.InputOffset()
+		e := &InventoryEntry{}
+		if err := dec.Decode(e); err != nil {
+			return nil, err
+		}
+		e.line = 1 + bytes.Count(data[:start], []byte("\n"))
+		//跳过对象前的逗号和空白定位到对象开始的行
+		for i := start; i < int64(len(data)) && strings.ContainsRune(", \t\r\n", rune(data[i])); i++ {
+			if data[i] == '\n' {
+				e.line++
+			}
+		}
+		e.ServerID, e.Dir = strings.TrimSpace(e.ServerID), strings.TrimSpace(e.Dir)
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+//inventoryPath 获取清单文件的路径,相对路径相对于配置了inventory的配置文件所在的目录,调用方需持有锁
+func (upcfg *UpdateCfg) inventoryPath() string {
+	path := upcfg.inventory
+	if len(path) == 0 || filepath.IsAbs(path) {
+		return path
+	}
+	if source, ok := upcfg.sources["inventory"]; ok && len(source.file) > 0 {
+		return filepath.Join(filepath.Dir(source.file), path)
+	}
+	return path
+}
+
+//checkInventory 清单文件只支持csv和json
+func checkInventory(value string) string {
+	if len(value) == 0 {
+		return ""
+	}
+	if ext := strings.ToLower(filepath.Ext(value)); ext != ".csv" && ext != ".json" {
+		return "must be a .csv or .json file"
+	}
+	return ""
+}
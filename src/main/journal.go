@@ -0,0 +1,502 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+)
+
+//Journal_File 更新日志文件,在程序所在目录下,只保留最近一次更新
+const Journal_File = "update_journal.jsonl"
+
+//更新日志记录的类型
+const (
+	Journal_Session       = "session"       //开始一次更新,记录配置文件和命名配置
+	Journal_Component     = "component"     //开始更新一个组件,记录需要更新的所有目标
+	Journal_Stage         = "stage"         //开始更新一个阶段,记录阶段号和阶段中的目标
+	Journal_Gate          = "gate"          //阶段之后的健康检查结果
+	Journal_Target        = "target"        //开始更新一个目标
+	Journal_Step          = "step"          //目标的一步操作
+	Journal_Target_End    = "target_end"    //目标更新结束(失败时已回滚)
+	Journal_Component_End = "component_end" //组件更新结束
+	Journal_Session_End   = "session_end"   //本次更新结束,之后不需要resume
+)
+
+//操作和目标的状态
+const (
+	Step_Start   = "start"   //操作开始前
+	Step_Done    = "done"    //操作成功,目标结束时表示更新成功
+	Step_Fail    = "fail"    //操作失败,目标结束时表示更新失败并已回滚
+	Step_Undone  = "undone"  //回滚时已撤销该操作
+	Step_Stopped = "stopped" //组件因错误停止了后续的更新
+)
+
+//JournalEntry 更新日志中的一条记录,一行一个json
+type JournalEntry struct {
+	Time      string   `json:"time"`
+	Type      string   `json:"type"`
+	Config    string   `json:"config,omitempty"`
+	Profile   string   `json:"profile,omitempty"`
+	Plan      string   `json:"plan,omitempty"`
+	Component string   `json:"component,omitempty"`
+	Targets   []string `json:"targets,omitempty"`
+	Stage     int      `json:"stage,omitempty"`
+	ServerID  string   `json:"server_id,omitempty"`
+	Op        string   `json:"op,omitempty"`
+	Path      string   `json:"path,omitempty"`
+	Dest      string   `json:"dest,omitempty"`
+	State     string   `json:"state,omitempty"`
+}
+
+//Journal 更新日志,每一步操作前后各写一条记录并立即刷到磁盘,进程中途退出后resume根据它完成或回滚中断的目标
+//为nil时不记录,预演和rollback命令不使用
+type Journal struct {
+	path string
+	file *os.File
+	mu   sync.Mutex
+}
+
+//JournalPath 更新日志的路径:程序所在目录下的update_journal.jsonl
+func JournalPath() string {
+	dir, _ := filepath.Abs(filepath.Dir(os.Args[0]))
+	return dir + string(os.PathSeparator) + Journal_File
+}
+
+//NewJournal 开始一次新的更新,plan为apply的计划文件,上次的更新没有正常结束时拒绝,需要先resume
+func NewJournal(path, config, profile, plan string) (*Journal, error) {
+	state, err := LoadJournal(path)
+	if err != nil {
+		return nil, err
+	}
+	if state != nil && !state.ended {
+		return nil, fmt.Errorf("the last update (config %s) was interrupted, run \"UpdateProgram resume\" to finish it first, or \"UpdateProgram resume -discard\" after checking the targets by hand", state.Config)
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("create journal %s fail: %s", path, err)
+	}
+	j := &Journal{path: path, file: file}
+	j.write(&JournalEntry{Type: Journal_Session, Config: config, Profile: profile, Plan: plan})
+	return j, nil
+}
+
+//OpenJournal 打开中断的更新日志继续追加记录,用于resume
+func OpenJournal(path string) (*Journal, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("open journal %s fail: %s", path, err)
+	}
+	return &Journal{path: path, file: file}, nil
+}
+
+//write 写入一条记录并刷到磁盘,写入失败只记录错误不中断更新
+func (j *Journal) write(e *JournalEntry) {
+	if j == nil {
+		return
+	}
+	e.Time = time.Now().Format("2006-01-02 15:04:05")
+	data, err := json.Marshal(e)
+	if err != nil {
+		logU.ErrorDoo("Write journal fail:", err)
+		return
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if _, err := j.file.Write(append(data, '\n')); err != nil {
+		logU.ErrorDoo("Write journal", j.path, "fail:", err)
+		return
+	}
+	if err := j.file.Sync(); err != nil {
+		logU.ErrorDoo("Sync journal", j.path, "fail:", err)
+	}
+}
+
+//Component 开始更新一个组件,targets为按更新顺序的所有目标
+func (j *Journal) Component(name string, targets []string) {
+	j.write(&JournalEntry{Type: Journal_Component, Component: name, Targets: targets})
+}
+
+//ComponentEnd 组件更新结束,stopped为true表示因错误停止了后续的更新
+func (j *Journal) ComponentEnd(name string, stopped bool) {
+	state := Step_Done
+	if stopped {
+		state = Step_Stopped
+	}
+	j.write(&JournalEntry{Type: Journal_Component_End, Component: name, State: state})
+}
+
+//Stage 开始更新第n个阶段,resume时继续中断的阶段会再次记录同一个阶段号
+func (j *Journal) Stage(n int, targets []string) {
+	j.write(&JournalEntry{Type: Journal_Stage, Stage: n, Targets: targets})
+}
+
+//Gate 第n个阶段之后的健康检查结果
+func (j *Journal) Gate(n int, passed bool) {
+	state := Step_Done
+	if !passed {
+		state = Step_Fail
+	}
+	j.write(&JournalEntry{Type: Journal_Gate, Stage: n, State: state})
+}
+
+//Target 开始更新一个目标
+func (j *Journal) Target(k string) {
+	j.write(&JournalEntry{Type: Journal_Target, ServerID: k})
+}
+
+//TargetEnd 目标更新结束,err不为nil时表示更新失败(已回滚)
+func (j *Journal) TargetEnd(k string, err error) {
+	state := Step_Done
+	if err != nil {
+		state = Step_Fail
+	}
+	j.write(&JournalEntry{Type: Journal_Target_End, ServerID: k, State: state})
+}
+
+//Step 目标的一步操作
+func (j *Journal) Step(k, op, path, dest, state string) {
+	j.write(&JournalEntry{Type: Journal_Step, ServerID: k, Op: op, Path: path, Dest: dest, State: state})
+}
+
+//Close 本次更新结束,之后的更新不需要resume
+func (j *Journal) Close() {
+	if j == nil {
+		return
+	}
+	j.write(&JournalEntry{Type: Journal_Session_End})
+	j.file.Close()
+}
+
+//JournalState 从更新日志中恢复的最近一次更新的状态
+type JournalState struct {
+	Config     string
+	Profile    string
+	Plan       string //apply时的计划文件,resume时拷贝的文件同样要与计划一致
+	ended      bool
+	components map[string]*componentJournal
+}
+
+//componentJournal 一个组件的更新状态
+type componentJournal struct {
+	targets []string                   //需要更新的所有目标,按更新顺序
+	started map[string]bool            //已经开始更新的目标
+	ended   map[string]string          //已经结束的目标 + 结果
+	steps   map[string][]*JournalEntry //目标 + 已记录的操作
+	done    bool                       //组件已经更新结束
+
+	stage         int      //最后开始的阶段号,没有记录阶段时为0
+	stage_targets []string //最后开始的阶段中的目标
+	gate          string   //最后开始的阶段之后的健康检查结果,为空表示还没有检查
+}
+
+//LoadJournal 读取更新日志中最近一次更新的状态,文件不存在时返回nil
+//进程退出时最后一行可能只写了一部分,无法解析的行直接跳过
+func LoadJournal(path string) (*JournalState, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("open journal %s fail: %s", path, err)
+	}
+	defer file.Close()
+
+	var state *JournalState
+	var comp *componentJournal
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		e := &JournalEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), e); err != nil {
+			continue
+		}
+		if e.Type == Journal_Session {
+			state = &JournalState{Config: e.Config, Profile: e.Profile, Plan: e.Plan, components: make(map[string]*componentJournal, 0)}
+			comp = nil
+			continue
+		}
+		if state == nil {
+			continue
+		}
+
+		switch e.Type {
+		case Journal_Component:
+			comp = &componentJournal{
+				targets: e.Targets,
+				started: make(map[string]bool, 0),
+				ended:   make(map[string]string, 0),
+				steps:   make(map[string][]*JournalEntry, 0),
+			}
+			//resume时组件不会重新记录开始,只有第一次的目标列表是完整的
+			if _, ok := state.components[e.Component]; !ok {
+				state.components[e.Component] = comp
+			} else {
+				comp = state.components[e.Component]
+			}
+		case Journal_Component_End:
+			if c, ok := state.components[e.Component]; ok {
+				c.done = true
+			}
+		case Journal_Session_End:
+			state.ended = true
+		}
+		if comp == nil {
+			continue
+		}
+
+		switch e.Type {
+		case Journal_Stage:
+			if e.Stage != comp.stage {
+				comp.stage, comp.stage_targets = e.Stage, nil
+			}
+			comp.stage_targets = append(comp.stage_targets, e.Targets...)
+			comp.gate = ""
+		case Journal_Gate:
+			if e.Stage == comp.stage {
+				comp.gate = e.State
+			}
+		case Journal_Target:
+			comp.started[e.ServerID] = true
+		case Journal_Target_End:
+			comp.ended[e.ServerID] = e.State
+		case Journal_Step:
+			comp.steps[e.ServerID] = append(comp.steps[e.ServerID], e)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read journal %s fail: %s", path, err)
+	}
+	return state, nil
+}
+
+//Interrupted 最近一次更新是否没有正常结束
+func (js *JournalState) Interrupted() bool {
+	return js != nil && !js.ended
+}
+
+//ComponentDone 组件在中断前是否已经更新结束
+func (js *JournalState) ComponentDone(name string) bool {
+	if js == nil {
+		return false
+	}
+	c, ok := js.components[name]
+	return ok && c.done
+}
+
+//ComponentStarted 组件在中断前是否已经开始更新
+func (js *JournalState) ComponentStarted(name string) bool {
+	if js == nil {
+		return false
+	}
+	_, ok := js.components[name]
+	return ok
+}
+
+//Resume 恢复中断的组件:先完成或回滚开始了但没有结束的目标,再把还没有开始的目标留给StartUpdate
+//中断的阶段还没有进行健康检查时(例如在soak_time中退出),阶段中的目标都已开始的在这里检查,不通过时不再更新后续的阶段
+//阶段中还有没开始的目标时把已结束的目标的结果留给StartUpdate,与第一个阶段一起检查,返回恢复的目标中更新成功和失败的显示名
+func (js *JournalState) Resume(name string, up *UpdateProgram) (successServerName, failServerName []string) {
+	if js == nil {
+		return
+	}
+	c, ok := js.components[name]
+	if !ok {
+		return
+	}
+
+	//已经结束的目标是否更新成功,包括这里完成或回滚的
+	succeeded := make(map[string]bool, 0)
+	for k, state := range c.ended {
+		succeeded[k] = state == Step_Done
+	}
+	for _, k := range c.targets {
+		if !c.started[k] || len(c.ended[k]) > 0 {
+			continue
+		}
+		if _, ok := up.target_dir[k]; !ok {
+			logU.ErrorDoo("serverID:", k, "was interrupted but is not a target of the current config, please check it by hand")
+			if display, ok := up.target_display[k]; ok {
+				failServerName = append(failServerName, display)
+			} else {
+				failServerName = append(failServerName, "serverID "+k+" (not in current config)")
+			}
+			continue
+		}
+		if err := up.recoverTarget(k, c.steps[k]); err != nil {
+			failServerName = append(failServerName, up.target_display[k])
+		} else {
+			successServerName = append(successServerName, up.target_display[k])
+			succeeded[k] = true
+		}
+	}
+
+	//只保留还没有开始更新的目标,阶段的划分不变
+	remaining := make([]string, 0)
+	for _, k := range up.order {
+		if !c.started[k] {
+			remaining = append(remaining, k)
+		}
+	}
+	stages := make([][]string, 0)
+	for _, stage := range up.stages {
+		s := make([]string, 0)
+		for _, k := range stage {
+			if !c.started[k] {
+				s = append(s, k)
+			}
+		}
+		if len(s) > 0 {
+			stages = append(stages, s)
+		}
+	}
+	//前面的阶段都已开始,阶段号从中断的阶段(还有没开始的目标时)或它的下一个阶段继续
+	up.stage_base = len(up.stages) - len(stages)
+	up.order, up.stages = remaining, stages
+
+	up.resume_updated = make([]string, 0)
+	for _, k := range c.targets {
+		if succeeded[k] {
+			up.resume_updated = append(up.resume_updated, k)
+		}
+	}
+	if c.gate == Step_Fail {
+		logU.ErrorDoo("Health gate after stage", c.stage, "failed before the interruption, rollout halted, the rest targets are not updated")
+		up.halt()
+		return
+	}
+	if c.stage == 0 || len(c.gate) > 0 || len(stages) == 0 {
+		return
+	}
+
+	stageUpdated, failed := make([]string, 0), make([]string, 0)
+	for _, k := range c.stage_targets {
+		if succeeded[k] {
+			stageUpdated = append(stageUpdated, k)
+		} else if c.started[k] {
+			failed = append(failed, k)
+		}
+	}
+	if up.stage_base < c.stage {
+		up.stage_updated, up.stage_failed = stageUpdated, failed
+		return
+	}
+	logU.InfoDoo("Stage", c.stage, "was interrupted before the health gate, check it before the next stage")
+	passed := up.healthGate(c.stage, stageUpdated, failed, up.resume_updated)
+	up.journal.Gate(c.stage, passed)
+	if !passed {
+		logU.ErrorDoo("Health gate after stage", c.stage, "fail, rollout halted, the rest", len(stages), "stages are not updated")
+		up.halt()
+	}
+	return
+}
+
+//recoverTarget 处理中断的目标:已经重启成功(配置了hook_post_restart时还要执行成功)的只需要清理多余的备份即完成更新
+//否则按日志撤销已经开始的操作,用本次的备份还原所有文件,重启过服务时再次重启使旧版本运行
+func (up *UpdateProgram) recoverTarget(k string, steps []*JournalEntry) error {
+	start := up.mark()
+	restarted, finished := false, false
+	hooked := len(up.hooks[Hook_Post_Restart]) == 0
+	undone := make(map[UpdateAction]bool, 0)
+	for _, e := range steps {
+		a := UpdateAction{ServerID: k, Op: e.Op, Path: e.Path, Dest: e.Dest}
+		switch {
+		case e.State == Step_Undone:
+			undone[a] = true
+		case e.Op == Action_Restart && e.State == Step_Start:
+			restarted = true
+		case e.Op == Action_Restart && e.State == Step_Done:
+			finished = true
+		case e.Op == Action_Hook && e.Path == Hook_Post_Restart && e.State == Step_Done:
+			hooked = true
+		}
+	}
+
+	if finished && hooked {
+		up.log(k).InfoDoo("was interrupted after the service restarted, finish the update")
+		up.pruneBackups(k)
+		up.journal.TargetEnd(k, nil)
+		return nil
+	}
+
+	//开始了但没有记录结果的操作可能已经执行,也需要撤销,撤销操作会跳过已经还原的文件
+	for _, e := range steps {
+		a := UpdateAction{ServerID: k, Op: e.Op, Path: e.Path, Dest: e.Dest}
+		if e.State != Step_Start || undone[a] {
+			continue
+		}
+		switch e.Op {
+		case Action_Backup, Action_Copy, Action_Rename, Action_Restore:
+			up.record(k, e.Op, e.Path, e.Dest)
+		}
+	}
+
+	up.log(k).InfoDoo("was interrupted before the update finished, roll back", len(up.actions)-start, "actions")
+	up.rollback(k, start, restarted)
+	err := fmt.Errorf("interrupted and rolled back")
+	up.runFailureHook(k, up.hookEnv(k, up.exeVersion(k)), err)
+	up.journal.TargetEnd(k, err)
+	return err
+}
+
+//RunResume 完成或回滚上次中断的更新中正在更新的目标,再继续更新剩下的目标和组件
+func RunResume(args []string) {
+	cf := NewCmdFlags(Cmd_Resume)
+	discard := cf.Bool("discard", false, "drop the journal of the interrupted update without touching any target, use it after checking the targets by hand")
+	cf.Parse(args)
+
+	path := JournalPath()
+	state, err := LoadJournal(path)
+	if err != nil {
+		logU.ErrorDoo(err)
+		return
+	}
+	if !state.Interrupted() {
+		logU.InfoDoo("No interrupted update found in", path)
+		return
+	}
+	if *discard {
+		if err := os.Remove(path); err != nil {
+			logU.ErrorDoo("Remove journal", path, "fail:", err)
+			return
+		}
+		logU.InfoDoo("Journal", path, "discarded")
+		return
+	}
+
+	//默认使用中断的更新所用的配置
+	if len(*cf.config) == 0 {
+		*cf.config = state.Config
+	}
+	if len(*cf.profile) == 0 {
+		*cf.profile = state.Profile
+	}
+	updateCfg, err := cf.LoadCfg()
+	if err != nil {
+		logU.ErrorDoo(err)
+		WaitQuit("**Resume refused please fix the config first**")
+		return
+	}
+
+	var plan *UpdatePlan
+	if len(state.Plan) > 0 {
+		if plan, err = LoadUpdatePlan(state.Plan); err != nil {
+			logU.ErrorDoo("The interrupted update applied plan", state.Plan, "load it fail:", err)
+			return
+		}
+	}
+	journal, err := OpenJournal(path)
+	if err != nil {
+		logU.ErrorDoo(err)
+		return
+	}
+	logU.InfoDoo("Resume the interrupted update of config", state.Config)
+	updateAll(updateCfg, journal, state, plan)
+
+	WaitQuit("**Resume end please check the log to confirm update result**")
+}
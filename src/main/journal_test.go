@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+)
+
+//writeJournal 把记录写入临时目录下的更新日志,partial为最后追加的不完整的一行
+func writeJournal(t *testing.T, entries []*JournalEntry, partial string) string {
+	path := filepath.Join(t.TempDir(), Journal_File)
+	data := make([]byte, 0)
+	for _, e := range entries {
+		line, err := json.Marshal(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data = append(append(data, line...), '\n')
+	}
+	if err := os.WriteFile(path, append(data, partial...), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+//进程退出时最后一行只写了一部分,跳过它后仍能恢复之前的状态
+func TestLoadJournalPartialLine(t *testing.T) {
+	path := writeJournal(t, []*JournalEntry{
+		{Type: Journal_Session, Config: "config.ini"},
+		{Type: Journal_Component, Component: "GW", Targets: []string{"1001", "1002"}},
+		{Type: Journal_Target, ServerID: "1001"},
+		{Type: Journal_Step, ServerID: "1001", Op: Action_Backup, Path: "a.dll", Dest: "a(j20240101_0).dll", State: Step_Start},
+	}, `{"time":"2024-01-01 10:00:00","type":"step","server_id":"1001","op":"backup","pa`)
+
+	state, err := LoadJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !state.Interrupted() || !state.ComponentStarted("GW") || state.ComponentDone("GW") {
+		t.Fatalf("state interrupted %v started %v done %v", state.Interrupted(), state.ComponentStarted("GW"), state.ComponentDone("GW"))
+	}
+	c := state.components["GW"]
+	if !c.started["1001"] || c.started["1002"] || len(c.steps["1001"]) != 1 {
+		t.Errorf("started %v steps %d, want only 1001 with 1 step", c.started, len(c.steps["1001"]))
+	}
+
+	missing, err := LoadJournal(filepath.Join(t.TempDir(), Journal_File))
+	if missing != nil || err != nil || missing.Interrupted() {
+		t.Errorf("LoadJournal of a missing file = %v, %v", missing, err)
+	}
+}
+
+//上次resume时已经撤销的操作不再撤销,只撤销开始了但没有撤销的操作
+func TestRecoverTargetUndoneSteps(t *testing.T) {
+	dir := t.TempDir()
+	live, back := filepath.Join(dir, "a.dll"), filepath.Join(dir, "a(j20240101_0).dll")
+	touch(t, dir, "a(j20240101_0).dll")
+	copied := filepath.Join(dir, "b.dll")
+
+	up := NewUpdateProgram()
+	up.target_dir = map[string]string{"1001": dir}
+	up.target_exe_file = map[string]string{"1001": filepath.Join(dir, "GW.exe")}
+	err := up.recoverTarget("1001", []*JournalEntry{
+		{Op: Action_Backup, Path: live, Dest: back, State: Step_Start},
+		{Op: Action_Backup, Path: live, Dest: back, State: Step_Done},
+		{Op: Action_Copy, Path: "/src/a.dll", Dest: live, State: Step_Start},
+		{Op: Action_Copy, Path: "/src/b.dll", Dest: copied, State: Step_Start},
+		{Op: Action_Copy, Path: "/src/a.dll", Dest: live, State: Step_Undone},
+	})
+	if err == nil {
+		t.Error("an interrupted target should be rolled back")
+	}
+
+	want := []UpdateAction{
+		{ServerID: "1001", Op: Action_Backup, Path: live, Dest: back},
+		{ServerID: "1001", Op: Action_Copy, Path: "/src/b.dll", Dest: copied},
+	}
+	got := make([]UpdateAction, 0)
+	for _, a := range up.actions {
+		got = append(got, *a)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("rolled back %v, want %v", got, want)
+	}
+	if data, err := os.ReadFile(live); err != nil || string(data) != "a(j20240101_0).dll" {
+		t.Errorf("a.dll = %q, %v, want the backup restored", data, err)
+	}
+	if FileIsExisted(back) {
+		t.Error("backup should be renamed back")
+	}
+}
+
+//resume时继续同一个阶段会再次记录阶段号,阶段中的目标合并
+func TestLoadJournalStageGate(t *testing.T) {
+	path := writeJournal(t, []*JournalEntry{
+		{Type: Journal_Session, Config: "config.ini"},
+		{Type: Journal_Component, Component: "GW", Targets: []string{"1001", "1002", "1003", "1004"}},
+		{Type: Journal_Stage, Stage: 1, Targets: []string{"1001"}},
+		{Type: Journal_Target, ServerID: "1001"},
+		{Type: Journal_Target_End, ServerID: "1001", State: Step_Done},
+		{Type: Journal_Gate, Stage: 1, State: Step_Done},
+		{Type: Journal_Stage, Stage: 2, Targets: []string{"1002"}},
+		{Type: Journal_Stage, Stage: 2, Targets: []string{"1003"}},
+	}, "")
+
+	state, err := LoadJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := state.components["GW"]
+	if c.stage != 2 || len(c.gate) != 0 || !reflect.DeepEqual(c.stage_targets, []string{"1002", "1003"}) {
+		t.Errorf("stage %d targets %v gate %q, want stage 2 [1002 1003] without gate", c.stage, c.stage_targets, c.gate)
+	}
+}
+
+//在soak_time中退出时中断的阶段还没有健康检查,resume要先检查再更新后续的阶段
+func TestResumeGatesInterruptedStage(t *testing.T) {
+	path := writeJournal(t, []*JournalEntry{
+		{Type: Journal_Session, Config: "config.ini"},
+		{Type: Journal_Component, Component: "GW", Targets: []string{"1001", "1002", "1003"}},
+		{Type: Journal_Stage, Stage: 1, Targets: []string{"1001", "1002"}},
+		{Type: Journal_Target, ServerID: "1001"},
+		{Type: Journal_Target_End, ServerID: "1001", State: Step_Done},
+		{Type: Journal_Target, ServerID: "1002"},
+		{Type: Journal_Target_End, ServerID: "1002", State: Step_Fail},
+	}, "")
+	state, err := LoadJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	up := NewUpdateProgram()
+	up.order = []string{"1001", "1002", "1003"}
+	up.stages = [][]string{{"1001", "1002"}, {"1003"}}
+	state.Resume("GW", up)
+	if !up.stopped {
+		t.Error("resume should halt when the interrupted stage has a failed target")
+	}
+	if up.stage_base != 1 || !reflect.DeepEqual(up.resume_updated, []string{"1001"}) {
+		t.Errorf("stage_base %d resume_updated %v", up.stage_base, up.resume_updated)
+	}
+
+	//中断的阶段还有没开始的目标时留给StartUpdate一起检查
+	up = NewUpdateProgram()
+	up.order = []string{"1001", "1002", "1003", "1004"}
+	up.stages = [][]string{{"1001", "1002", "1003"}, {"1004"}}
+	state.Resume("GW", up)
+	if up.stopped || up.stage_base != 0 {
+		t.Fatalf("stopped %v stage_base %d, want the stage continued", up.stopped, up.stage_base)
+	}
+	if !reflect.DeepEqual(up.stages, [][]string{{"1003"}, {"1004"}}) ||
+		!reflect.DeepEqual(up.stage_updated, []string{"1001"}) || !reflect.DeepEqual(up.stage_failed, []string{"1002"}) {
+		t.Errorf("stages %v stage_updated %v stage_failed %v", up.stages, up.stage_updated, up.stage_failed)
+	}
+}
+
+//中断的目标已不在当前的配置中时,结果中要标明,不能只有serverID
+func TestResumeTargetNotInConfig(t *testing.T) {
+	path := writeJournal(t, []*JournalEntry{
+		{Type: Journal_Session, Config: "config.ini"},
+		{Type: Journal_Component, Component: "GW", Targets: []string{"1001", "1002"}},
+		{Type: Journal_Target, ServerID: "1001"},
+	}, "")
+	state, err := LoadJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	up := NewUpdateProgram()
+	up.order = []string{"1002"}
+	up.target_dir = map[string]string{"1002": "/s/1002"}
+	success, fail := state.Resume("GW", up)
+	if len(success) != 0 || !reflect.DeepEqual(fail, []string{"serverID 1001 (not in current config)"}) {
+		t.Errorf("Resume = %v, %v", success, fail)
+	}
+}
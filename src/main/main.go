@@ -6,6 +6,7 @@ import (
 	"logdoo"
 	"os"
 	"path/filepath"
+	"strings"
 
 )
 
@@ -22,22 +23,134 @@ func init() {
 	}
 }
 
-//函数入口
+//函数入口,第一个参数不是-开头时表示要执行的命令,默认执行update
 func main() {
+	cmd, args := Cmd_Update, os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, args = args[0], args[1:]
+	}
+
+	switch cmd {
+	case Cmd_Update:
+		RunUpdate(args)
+	case Cmd_Explain:
+		RunExplain(args)
+	case Cmd_Init:
+		RunInit(args)
+	case Cmd_Daemon:
+		RunDaemon(args)
+	case Cmd_Discover:
+		RunDiscover(args)
+	case Cmd_Status:
+		RunStatus(args)
+	case Cmd_Plan:
+		RunPlan(args)
+	case Cmd_Apply:
+		RunApply(args)
+	case Cmd_Rollback:
+		RunRollback(args)
+	case Cmd_Resume:
+		RunResume(args)
+	default:
+		fmt.Print(Cmd_Usage)
+	}
+}
+
+//RunUpdate 加载配置并更新所有目标服务
+func RunUpdate(args []string) {
+	cf := NewCmdFlags(Cmd_Update)
+	dryRun := cf.Bool("dry_run", false, "do not rename, copy, delete or restart anything, only print the actions every target would take")
+	cf.Parse(args)
 
-	//获取配置目录
-	cfgpath, err := GetCfgPath()
+	//配置有问题时拒绝更新,打印所有问题等待确认后退出
+	updateCfg, err := cf.LoadCfg()
 	if err != nil {
 		logU.ErrorDoo(err)
+		WaitQuit("**Update refused please fix the config first (or run \"UpdateProgram init\" to create one)**")
 		return
 	}
 
-	updateCfg := NewUpdateCfg()
-	updateCfg.Load(cfgpath)
+	if *dryRun {
+		DryRunAll(updateCfg)
+		WaitQuit("**Dry run end nothing was changed**")
+		return
+	}
 
-	updateProgram := NewUpdateProgram()
-	updateProgram.Load(updateCfg)
-	successList, failList := updateProgram.StartUpdate()
+	UpdateAll(updateCfg)
+
+	WaitQuit("**Update end please check the log to confirm update result**")
+}
+
+//UpdateAll 按配置更新所有目标服务并打印更新结果
+//配置了components时按顺序更新每个组件,某个组件因错误停止更新时后续的组件也不再更新,结果合并在一起打印
+//每一步操作都写入更新日志,上次的更新中断后没有resume时拒绝更新
+func UpdateAll(updateCfg *UpdateCfg) {
+	UpdateAllBy(updateCfg, nil)
+}
+
+//UpdateAllBy 同UpdateAll,plan不为nil时(apply)拷贝的每个文件都要与计划中源文件的SHA-256一致,计划文件记录到更新日志中供resume使用
+func UpdateAllBy(updateCfg *UpdateCfg, plan *UpdatePlan) {
+	updateCfg.mu.RLock()
+	config, profile := updateCfg.path, updateCfg.profile
+	updateCfg.mu.RUnlock()
+
+	planPath := ""
+	if plan != nil {
+		planPath, _ = filepath.Abs(plan.path)
+	}
+	journal, err := NewJournal(JournalPath(), config, profile, planPath)
+	if err != nil {
+		logU.ErrorDoo("Update refused:", err)
+		return
+	}
+	updateAll(updateCfg, journal, nil, plan)
+}
+
+//updateAll 更新所有组件,resume不为nil时跳过中断前已经更新结束的组件,并先恢复中断的组件中正在更新的目标
+func updateAll(updateCfg *UpdateCfg, journal *Journal, resume *JournalState, plan *UpdatePlan) {
+	var successList, failList []string
+	for _, comp := range updateCfg.Components() {
+		name := comp.Name()
+		if resume.ComponentDone(name) {
+			logU.InfoDoo("Component", name, "was updated before the interruption, skip it")
+			continue
+		}
+		prefix := ""
+		if len(name) > 0 {
+			logU.InfoDoo("Update component:", name)
+			prefix = name + ": "
+		}
+
+		updateProgram := NewUpdateProgram()
+		if err := updateProgram.Load(comp); err != nil {
+			failList = append(failList, prefix+err.Error())
+			continue
+		}
+		updateProgram.journal = journal
+		if plan != nil {
+			updateProgram.source_sums = plan.SourceSums(name)
+		}
+
+		var success, fail []string
+		if resume.ComponentStarted(name) {
+			success, fail = resume.Resume(name, updateProgram)
+		} else {
+			journal.Component(name, updateProgram.order)
+		}
+		s, f := updateProgram.StartUpdate()
+		journal.ComponentEnd(name, updateProgram.stopped)
+		for _, s := range append(success, s...) {
+			successList = append(successList, prefix+s)
+		}
+		for _, s := range append(fail, f...) {
+			failList = append(failList, prefix+s)
+		}
+		if updateProgram.stopped {
+			logU.ErrorDoo("Update stopped, the rest components are not updated")
+			break
+		}
+	}
+	journal.Close()
 
 	//打印更新成功的serverID
 	str := "\r\n"
@@ -54,9 +167,12 @@ func main() {
 	logU.InfoDoo("Update Fail List:", str)
 
 	logU.InfoDoo()
+}
 
+//WaitQuit 打印提示后等待输入q退出,避免控制台窗口直接关闭
+func WaitQuit(tip string) {
 	reader := bufio.NewReader(os.Stdin)
-	fmt.Print("**Update end please check the log to confirm update result**\n\n")
+	fmt.Print(tip + "\n\n")
 	fmt.Print(">>please input q to quit\n")
 	reader.ReadString('q')
 }
@@ -92,17 +208,27 @@ func CreateLogDir(logName string) (string, error) {
 	return logpath, nil
 }
 
-//GetCfgPath 获取当前配置文件的路径
-func GetCfgPath() (string, error) {
+//DefaultCfgPath 默认的配置文件路径:程序所在目录下的config\config.ini
+func DefaultCfgPath() string {
+	PthSep := string(os.PathSeparator)
+	dir, _ := filepath.Abs(filepath.Dir(os.Args[0]))
+	return dir + PthSep + "config" + PthSep + "config.ini"
+}
+
+//GetCfgPath 获取当前配置文件的路径,按CfgFileExts的顺序查找config目录下的config.*,都不存在时按encoding编码生成ini模板
+func GetCfgPath(encoding string) (string, error) {
 	// 获取当前路径
 	PthSep := string(os.PathSeparator)
 
 	dir, _ := filepath.Abs(filepath.Dir(os.Args[0]))
-	cfgpath := dir + PthSep + "config" + PthSep + "config.ini"
-	if PathExists(cfgpath) {
-		return cfgpath, nil
+	for _, ext := range CfgFileExts {
+		if p := dir + PthSep + "config" + PthSep + "config" + ext; PathExists(p) {
+			return p, nil
+		}
 	}
 
+	cfgpath := DefaultCfgPath()
+
 	if !PathExists(dir) {
 		os.MkdirAll(dir, os.ModePerm)
 	}
@@ -112,27 +238,9 @@ func GetCfgPath() (string, error) {
 	}
 
 	if !PathExists(cfgpath) {
-		file, err := os.Create(cfgpath)
-		if err != nil {
+		if err := WriteCfgTemplate(cfgpath, nil, encoding); err != nil {
 			return cfgpath, fmt.Errorf("config %s not exists and create it fail:%s", cfgpath, err)
 		}
-		defer file.Close()
-
-		initContent := "#[Signature] 签名配置信息(author用于记录更新人,exe_version表示服务需升级到的版本用于判断服务是否更新成功)\r\n" +
-			"[Signature]\r\nauthor=jarlen\r\nexe_version=1.0.0.1\r\n\n" +
-
-			"#[Update_Cfg] 更新配置\r\n" +
-			"##source_dir 源目录(更新文件的来源配合 source_file_suffix 使用表示具体更新该目录下的哪些类型的文件)\r\n" +
-			"#source_exe_name 源目录下的主程序文件名称\r\n" +
-			"#target_dir 更新到的目标目录（程序会遍历该目录获取所有的ServerID目录）再具体配合server_type 和 server_prefix 结合拼接成所有所有要更新的子服务目录\r\n" +
-			"#server_type 取值4或者5（代表是更新该serverid的mt5类型还是mt4类型）\r\n" +
-			"#server_prefix 要更新的服务名称的前缀\r\n" +
-			"#not_update_serverid 表示无需更新的serverID（使用,号隔开）,为空则表示全部都更新\r\n" +
-			"#backup_file_num 最多保留的备份的个数,多余并且最旧的会被清理掉\r\n" +
-			"#update_stop_flag更新停止标识是否启用（等于1启用:当更新到某个服务并且重启失败时就停止后续的更新，为0不启用）默认是0\r\n" +
-			"[Update_Cfg]\r\nsource_dir=\r\nsource_file_suffix=\r\nsource_exe_name=\r\ntarget_dir=\r\nserver_type=\r\nserver_prefix=\r\nnot_update_serverid=\r\nbackup_file_num=\r\nupdate_stop_flag=0\r\n\n"
-
-		file.WriteString(initContent)
 	}
 
 	return cfgpath, nil
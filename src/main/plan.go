@@ -0,0 +1,434 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+)
+
+//Plan_File_Default plan命令默认输出的计划文件
+const Plan_File_Default = "update_plan.json"
+
+//UpdatePlan 保存到文件中的更新计划,apply时重新计算的计划与之完全一致才会执行
+type UpdatePlan struct {
+	Created    string           `json:"created"`
+	Config     string           `json:"config"`
+	Profile    string           `json:"profile,omitempty"`
+	Components []*ComponentPlan `json:"components"`
+	path       string           //计划文件的路径
+}
+
+//SourceSums 组件的源文件名 + SHA-256,计划中没有该组件时返回空的map,拷贝任何文件都会校验失败
+func (plan *UpdatePlan) SourceSums(component string) map[string]string {
+	sums := make(map[string]string, 0)
+	for _, cp := range plan.Components {
+		if cp.Name != component {
+			continue
+		}
+		for _, s := range cp.Sources {
+			sums[s.Name] = s.SHA256
+		}
+	}
+	return sums
+}
+
+//ComponentPlan 一个组件(没有配置components时为当前配置)的更新计划
+//操作中的钩子只记录钩子名,钩子和健康检查的命令行记录在Commands中(配置项的名字 + 命令行),失败和分阶段的策略记录在Policy中
+type ComponentPlan struct {
+	Name       string            `json:"name,omitempty"`
+	ExeVersion string            `json:"exe_version"`
+	Sources    []*PlanSource     `json:"sources"`
+	Targets    []*PlanTarget     `json:"targets"`
+	Commands   map[string]string `json:"commands,omitempty"`
+	Policy     *PlanPolicy       `json:"policy"`
+	Actions    []*UpdateAction   `json:"actions"`
+}
+
+//PlanPolicy 组件更新时的失败和分阶段策略,以及按策略划分的每个阶段的serverID
+type PlanPolicy struct {
+	UpdateStopFlag int        `json:"update_stop_flag"`
+	UpdateParallel int        `json:"update_parallel"`
+	CanaryServerID string     `json:"canary_serverid,omitempty"`
+	CanaryCount    int        `json:"canary_count,omitempty"`
+	BatchSize      int        `json:"batch_size,omitempty"`
+	SoakTime       string     `json:"soak_time"`
+	Stages         [][]string `json:"stages"`
+}
+
+//Diff 比较计划中的策略与重新计算的策略,返回所有的不同,之前的计划没有记录策略时也算不同
+func (p *PlanPolicy) Diff(cur *PlanPolicy) []string {
+	if p == nil || cur == nil {
+		if p != cur {
+			return []string{"rollout policy is not recorded in the plan"}
+		}
+		return nil
+	}
+
+	diffs := make([]string, 0)
+	settings := []struct {
+		name      string
+		plan, now interface{}
+	}{
+		{"update_stop_flag", p.UpdateStopFlag, cur.UpdateStopFlag},
+		{"update_parallel", p.UpdateParallel, cur.UpdateParallel},
+		{"canary_serverid", p.CanaryServerID, cur.CanaryServerID},
+		{"canary_count", p.CanaryCount, cur.CanaryCount},
+		{"batch_size", p.BatchSize, cur.BatchSize},
+		{"soak_time", p.SoakTime, cur.SoakTime},
+	}
+	for _, s := range settings {
+		if s.plan != s.now {
+			diffs = append(diffs, fmt.Sprintf("%s changed: %v -> %v", s.name, s.plan, s.now))
+		}
+	}
+
+	for i := 0; i < len(p.Stages) || i < len(cur.Stages); i++ {
+		var before, after string
+		if i < len(p.Stages) {
+			before = strings.Join(p.Stages[i], ",")
+		}
+		if i < len(cur.Stages) {
+			after = strings.Join(cur.Stages[i], ",")
+		}
+		if before != after {
+			diffs = append(diffs, fmt.Sprintf("stage %d changed: %q -> %q", i+1, before, after))
+		}
+	}
+	return diffs
+}
+
+//planCommandNames 计划中记录命令行的配置项,按执行的先后顺序
+var planCommandNames = append(append([]string{}, HookNames...), "health_check")
+
+//PlanSource 源文件及其大小和SHA-256
+type PlanSource struct {
+	Name   string `json:"name"`
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+//PlanTarget 需要更新的目标,按更新顺序
+type PlanTarget struct {
+	ServerID string `json:"server_id"`
+	Dir      string `json:"dir"`
+	Exe      string `json:"exe"`
+	Service  string `json:"service"`
+	Display  string `json:"display"`
+}
+
+//NewComponentPlan 加载组件的更新目标并预演更新,得到组件的更新计划
+func NewComponentPlan(comp *UpdateCfg) (*ComponentPlan, error) {
+	up := NewUpdateProgram()
+	if err := up.Load(comp); err != nil {
+		return nil, err
+	}
+
+	cp := &ComponentPlan{Name: comp.Name(), ExeVersion: up.exe_version, Commands: make(map[string]string, 0)}
+	for _, name := range HookNames {
+		if len(up.hooks[name]) > 0 {
+			cp.Commands[name] = up.hooks[name]
+		}
+	}
+	if len(up.health_check) > 0 {
+		cp.Commands["health_check"] = up.health_check
+	}
+	comp.mu.RLock()
+	cp.Policy = &PlanPolicy{
+		UpdateStopFlag: up.update_stop_flag,
+		UpdateParallel: up.parallel,
+		CanaryServerID: comp.canary_serverid,
+		CanaryCount:    comp.canary_count,
+		BatchSize:      comp.batch_size,
+		SoakTime:       up.soak_time.String(),
+		Stages:         up.stages,
+	}
+	comp.mu.RUnlock()
+	for _, name := range sortedKeys(up.source_file) {
+		size, sum, err := fileDigest(up.source_file[name])
+		if err != nil {
+			return nil, fmt.Errorf("read source file %s fail: %s", up.source_file[name], err)
+		}
+		cp.Sources = append(cp.Sources, &PlanSource{Name: name, Path: up.source_file[name], Size: size, SHA256: sum})
+	}
+	for _, k := range up.order {
+		cp.Targets = append(cp.Targets, &PlanTarget{ServerID: k, Dir: up.target_dir[k], Exe: up.target_exe_file[k], Service: up.target_service[k], Display: up.target_display[k]})
+	}
+
+	up.SetDryRun(true)
+	up.StartUpdate()
+	cp.Actions = up.Actions()
+	return cp, nil
+}
+
+//Diff 比较计划与重新计算的计划,返回所有的不同,为空表示完全一致
+func (cp *ComponentPlan) Diff(cur *ComponentPlan) []string {
+	diffs := make([]string, 0)
+	if cp.ExeVersion != cur.ExeVersion {
+		diffs = append(diffs, "exe_version changed: "+cp.ExeVersion+" -> "+cur.ExeVersion)
+	}
+
+	sources := make(map[string]*PlanSource, 0)
+	for _, s := range cur.Sources {
+		sources[s.Name] = s
+	}
+	for _, s := range cp.Sources {
+		c, ok := sources[s.Name]
+		delete(sources, s.Name)
+		if !ok {
+			diffs = append(diffs, "source file removed: "+s.Path)
+		} else if c.Path != s.Path || c.SHA256 != s.SHA256 {
+			diffs = append(diffs, "source file changed: "+s.Path)
+		}
+	}
+	for _, s := range cur.Sources {
+		if _, ok := sources[s.Name]; ok {
+			diffs = append(diffs, "source file added: "+s.Path)
+		}
+	}
+
+	//钩子和健康检查的命令行以及分阶段的策略变化时操作不变,需要单独比较
+	for _, name := range planCommandNames {
+		if cp.Commands[name] != cur.Commands[name] {
+			diffs = append(diffs, fmt.Sprintf("%s changed: %q -> %q", name, cp.Commands[name], cur.Commands[name]))
+		}
+	}
+	diffs = append(diffs, cp.Policy.Diff(cur.Policy)...)
+
+	targets := make(map[string]*PlanTarget, 0)
+	for _, t := range cur.Targets {
+		targets[t.ServerID] = t
+	}
+	for _, t := range cp.Targets {
+		c, ok := targets[t.ServerID]
+		delete(targets, t.ServerID)
+		if !ok {
+			diffs = append(diffs, "target removed: serverID "+t.ServerID)
+		} else if *c != *t {
+			diffs = append(diffs, "target changed: serverID "+t.ServerID+" ("+t.Dir+" "+t.Service+" -> "+c.Dir+" "+c.Service+")")
+		}
+	}
+	for _, t := range cur.Targets {
+		if _, ok := targets[t.ServerID]; ok {
+			diffs = append(diffs, "target added: serverID "+t.ServerID)
+		}
+	}
+	if len(diffs) > 0 {
+		return diffs
+	}
+
+	//目标和源文件都没变时再比较顺序和每一步操作
+	for i, t := range cp.Targets {
+		if cur.Targets[i].ServerID != t.ServerID {
+			return append(diffs, "update order changed at "+strconv.Itoa(i+1)+": serverID "+t.ServerID+" -> "+cur.Targets[i].ServerID)
+		}
+	}
+	for i, a := range cp.Actions {
+		if i >= len(cur.Actions) {
+			return append(diffs, "action removed: "+a.String())
+		}
+		if !sameAction(cur.Actions[i], a) {
+			return append(diffs, "action changed: "+a.String()+" -> "+cur.Actions[i].String())
+		}
+	}
+	if len(cur.Actions) > len(cp.Actions) {
+		diffs = append(diffs, "action added: "+cur.Actions[len(cp.Actions)].String())
+	}
+	return diffs
+}
+
+//sameAction 比较两步操作,备份文件名中的日期和序号不参与比较,计划在之后的日期apply时备份文件名会变化
+func sameAction(a, b *UpdateAction) bool {
+	if a.Op == Action_Backup && b.Op == Action_Backup {
+		x, y := *a, *b
+		x.Dest, y.Dest = unstampBackupName(a.Dest), unstampBackupName(b.Dest)
+		return x == y
+	}
+	return *a == *b
+}
+
+//unstampBackupName 去掉备份文件名中的日期和序号,如 GW_1(jarlen20240101_0).exe 为 GW_1(jarlen).exe
+func unstampBackupName(path string) string {
+	i := strings.LastIndexAny(path, "\\/") + 1
+	m := backupNameReg.FindStringSubmatch(path[i:])
+	if m == nil {
+		return path
+	}
+	return path[:i] + m[1] + "(" + m[2] + ")" + m[5]
+}
+
+//checkPlanned apply时校验拷贝到目标目录的文件与计划中源文件的SHA-256一致,避免计划检查通过后源文件被替换,不是apply时直接通过
+func (up *UpdateProgram) checkPlanned(name, path string) error {
+	if up.source_sums == nil {
+		return nil
+	}
+	want, ok := up.source_sums[name]
+	if !ok {
+		return fmt.Errorf("%s is not a source file of the plan", name)
+	}
+	_, sum, err := fileDigest(path)
+	if err != nil {
+		return err
+	}
+	if sum != want {
+		return fmt.Errorf("%s does not match the plan, the source file changed after the plan was checked", path)
+	}
+	return nil
+}
+
+//samePath 两个路径是否为同一个文件,相对路径按当前目录计算,Windows下不区分大小写
+func samePath(a, b string) bool {
+	a, _ = filepath.Abs(a)
+	b, _ = filepath.Abs(b)
+	return strings.EqualFold(filepath.Clean(a), filepath.Clean(b))
+}
+
+//LoadUpdatePlan 读取计划文件
+func LoadUpdatePlan(path string) (*UpdatePlan, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	plan := &UpdatePlan{path: path}
+	if err := json.Unmarshal(data, plan); err != nil {
+		return nil, fmt.Errorf("plan %s is not valid json: %s", path, err)
+	}
+	return plan, nil
+}
+
+//RunPlan 预演所有组件的更新,把每个目标的操作和源文件的SHA-256写入计划文件,供审核后apply
+func RunPlan(args []string) {
+	cf := NewCmdFlags(Cmd_Plan)
+	out := cf.String("out", Plan_File_Default, "the plan file to write")
+	cf.Parse(args)
+
+	updateCfg, err := cf.LoadCfg()
+	if err != nil {
+		logU.ErrorDoo(err)
+		return
+	}
+
+	//记录绝对路径,apply时不论在哪个目录下执行都使用同一个配置文件
+	updateCfg.mu.RLock()
+	cfgpath, _ := filepath.Abs(updateCfg.path)
+	plan := &UpdatePlan{Created: time.Now().Format("2006-01-02 15:04:05"), Config: cfgpath, Profile: updateCfg.profile}
+	updateCfg.mu.RUnlock()
+	for _, comp := range updateCfg.Components() {
+		cp, err := NewComponentPlan(comp)
+		if err != nil {
+			logU.ErrorDoo("Plan component", comp.Name(), "fail:", err)
+			return
+		}
+		plan.Components = append(plan.Components, cp)
+
+		if len(cp.Name) > 0 {
+			fmt.Fprintf(os.Stdout, "\r\n==== component: %s ====\r\n", cp.Name)
+		}
+		for _, name := range planCommandNames {
+			if len(cp.Commands[name]) > 0 {
+				fmt.Fprintf(os.Stdout, "%s: %s\r\n", name, cp.Commands[name])
+			}
+		}
+		fmt.Fprintf(os.Stdout, "update_stop_flag: %d update_parallel: %d soak_time: %s\r\n", cp.Policy.UpdateStopFlag, cp.Policy.UpdateParallel, cp.Policy.SoakTime)
+		for i, stage := range cp.Policy.Stages {
+			fmt.Fprintf(os.Stdout, "stage %d: %s\r\n", i+1, strings.Join(stage, ","))
+		}
+		display := make(map[string]string, 0)
+		for _, t := range cp.Targets {
+			display[t.ServerID] = t.Display
+		}
+		PrintActions(os.Stdout, display, cp.Actions)
+	}
+
+	data, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		logU.ErrorDoo(err)
+		return
+	}
+	if err := ioutil.WriteFile(*out, data, 0644); err != nil {
+		logU.ErrorDoo("Write plan", *out, "fail:", err)
+		return
+	}
+	logU.InfoDoo("Write plan:", *out, "review it and run \"UpdateProgram apply "+*out+"\" to update")
+}
+
+//RunApply 重新计算更新计划,与计划文件完全一致时才按配置更新,源文件,目标,钩子和健康检查的命令,分阶段的策略或操作有任何变化都拒绝更新
+//更新时拷贝的每个文件都要与计划中源文件的SHA-256一致,默认使用计划中的配置文件和命名配置,指定了其它的时拒绝更新
+func RunApply(args []string) {
+	cf := NewCmdFlags(Cmd_Apply)
+	cf.Parse(args)
+	if cf.NArg() != 1 {
+		logU.ErrorDoo("usage: UpdateProgram apply [flags] <planfile>")
+		return
+	}
+
+	plan, err := LoadUpdatePlan(cf.Arg(0))
+	if err != nil {
+		logU.ErrorDoo("Load plan fail:", err)
+		return
+	}
+
+	//默认使用计划所用的配置,指定了其它的配置或命名配置时拒绝
+	if len(*cf.config) == 0 {
+		*cf.config = plan.Config
+	}
+	if len(*cf.profile) == 0 {
+		*cf.profile = plan.Profile
+	}
+	if !samePath(*cf.config, plan.Config) || *cf.profile != plan.Profile {
+		logU.ErrorDoo("Plan", cf.Arg(0), "was checked with config", plan.Config, "profile", plan.Profile, "but apply uses config", *cf.config, "profile", *cf.profile)
+		WaitQuit("**Apply refused please apply the plan with its own config or run plan again**")
+		return
+	}
+	updateCfg, err := cf.LoadCfg()
+	if err != nil {
+		logU.ErrorDoo(err)
+		WaitQuit("**Apply refused please fix the config first**")
+		return
+	}
+
+	diffs := make([]string, 0)
+	comps := updateCfg.Components()
+	if len(comps) != len(plan.Components) {
+		diffs = append(diffs, fmt.Sprintf("components changed: %d in plan, %d now", len(plan.Components), len(comps)))
+	}
+	for i := 0; i < len(comps) && i < len(plan.Components); i++ {
+		cur, err := NewComponentPlan(comps[i])
+		if err != nil {
+			diffs = append(diffs, "plan component "+comps[i].Name()+" fail: "+err.Error())
+			continue
+		}
+		if cur.Name != plan.Components[i].Name {
+			diffs = append(diffs, "component changed: "+plan.Components[i].Name+" -> "+cur.Name)
+			continue
+		}
+		for _, d := range plan.Components[i].Diff(cur) {
+			if len(cur.Name) > 0 {
+				d = cur.Name + ": " + d
+			}
+			diffs = append(diffs, d)
+		}
+	}
+
+	if len(diffs) > 0 {
+		str := "\r\n"
+		for _, d := range diffs {
+			str += d + "\r\n"
+		}
+		logU.ErrorDoo("Plan", cf.Arg(0), "(created "+plan.Created+") does not match the current state:", str)
+		WaitQuit("**Apply refused please run plan again and review it**")
+		return
+	}
+
+	logU.InfoDoo("Plan", cf.Arg(0), "(created "+plan.Created+") matches the current state, start update")
+	UpdateAllBy(updateCfg, plan)
+
+	WaitQuit("**Update end please check the log to confirm update result**")
+}
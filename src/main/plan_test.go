@@ -0,0 +1,138 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+)
+
+func TestUnstampBackupName(t *testing.T) {
+	cases := map[string]string{
+		`E:\s\1001\MT5\GW_1001(jarlen20240101_0).exe`: `E:\s\1001\MT5\GW_1001(jarlen).exe`,
+		"/s/1001/MT5/b(jarlen20240102_13).dll":        "/s/1001/MT5/b(jarlen).dll",
+		"/s/1001/MT5/b.dll":                           "/s/1001/MT5/b.dll",
+	}
+	for path, want := range cases {
+		if got := unstampBackupName(path); got != want {
+			t.Errorf("unstampBackupName(%q) = %q, want %q", path, got, want)
+		}
+	}
+}
+
+//计划在之后的日期apply时只有备份文件名中的日期和序号不同,不算变化
+func TestComponentPlanDiffBackupDate(t *testing.T) {
+	plan := &ComponentPlan{Actions: []*UpdateAction{
+		{ServerID: "1001", Op: Action_Backup, Path: "/s/GW_1001.exe", Dest: "/s/GW_1001(j20240101_0).exe"},
+		{ServerID: "1001", Op: Action_Copy, Path: "/src/a.exe", Dest: "/s/a.exe"},
+	}}
+	later := &ComponentPlan{Actions: []*UpdateAction{
+		{ServerID: "1001", Op: Action_Backup, Path: "/s/GW_1001.exe", Dest: "/s/GW_1001(j20240105_2).exe"},
+		{ServerID: "1001", Op: Action_Copy, Path: "/src/a.exe", Dest: "/s/a.exe"},
+	}}
+	if diffs := plan.Diff(later); len(diffs) != 0 {
+		t.Errorf("Diff = %v, want none", diffs)
+	}
+
+	later.Actions[0].Dest = "/s/GW_1001(k20240105_2).exe"
+	if diffs := plan.Diff(later); len(diffs) != 1 {
+		t.Errorf("Diff with another author = %v, want 1 difference", diffs)
+	}
+}
+
+//钩子和健康检查的命令行变化时操作中只有钩子名,同样要检查出来
+func TestComponentPlanDiffCommands(t *testing.T) {
+	plan := &ComponentPlan{Commands: map[string]string{Hook_Post_Restart: "check.bat", "health_check": "ping {server_id}"}}
+	cases := []struct {
+		commands map[string]string
+		diffs    int
+	}{
+		{map[string]string{Hook_Post_Restart: "check.bat", "health_check": "ping {server_id}"}, 0},
+		{map[string]string{Hook_Post_Restart: "check2.bat", "health_check": "ping {server_id}"}, 1},
+		{map[string]string{Hook_Post_Restart: "check.bat"}, 1},
+		{map[string]string{Hook_Pre_Backup: "stop.bat", Hook_Post_Restart: "check.bat", "health_check": "ping"}, 2},
+		{nil, 2},
+	}
+	for _, c := range cases {
+		if diffs := plan.Diff(&ComponentPlan{Commands: c.commands}); len(diffs) != c.diffs {
+			t.Errorf("Diff with commands %v = %v, want %d differences", c.commands, diffs, c.diffs)
+		}
+	}
+}
+
+//计划批准后关闭金丝雀或者不再出错停止,apply时要检查出来
+func TestPlanPolicyDiff(t *testing.T) {
+	policy := func() *PlanPolicy {
+		return &PlanPolicy{UpdateStopFlag: 1, UpdateParallel: 1, CanaryCount: 1, SoakTime: "10m0s",
+			Stages: [][]string{{"1001"}, {"1002", "1003"}}}
+	}
+	cases := []struct {
+		name   string
+		change func(p *PlanPolicy)
+		diffs  int
+	}{
+		{"same", func(p *PlanPolicy) {}, 0},
+		{"stop flag off", func(p *PlanPolicy) { p.UpdateStopFlag = 0 }, 1},
+		{"parallel", func(p *PlanPolicy) { p.UpdateParallel = 4 }, 1},
+		{"soak", func(p *PlanPolicy) { p.SoakTime = "0s" }, 1},
+		{"canary off", func(p *PlanPolicy) { p.CanaryCount = 0; p.Stages = [][]string{{"1001", "1002", "1003"}} }, 3},
+		{"canary by serverid", func(p *PlanPolicy) { p.CanaryCount = 0; p.CanaryServerID = "1001" }, 2},
+		{"batch", func(p *PlanPolicy) { p.BatchSize = 1; p.Stages = [][]string{{"1001"}, {"1002"}, {"1003"}} }, 3},
+	}
+	for _, c := range cases {
+		cur := policy()
+		c.change(cur)
+		if diffs := policy().Diff(cur); len(diffs) != c.diffs {
+			t.Errorf("%s: Diff = %v, want %d differences", c.name, diffs, c.diffs)
+		}
+	}
+
+	if diffs := (&ComponentPlan{}).Diff(&ComponentPlan{Policy: policy()}); len(diffs) != 1 {
+		t.Errorf("plan without policy: Diff = %v, want 1 difference", diffs)
+	}
+}
+
+//apply默认使用计划的配置文件,指定的配置文件写法不同但为同一个文件时不算不同
+func TestSamePath(t *testing.T) {
+	wd, _ := os.Getwd()
+	cases := []struct {
+		a, b string
+		want bool
+	}{
+		{filepath.Join(wd, "config", "config.ini"), filepath.Join("config", "config.ini"), true},
+		{filepath.Join(wd, "config", "config.ini"), filepath.Join(wd, "config", ".", "CONFIG.ini"), true},
+		{filepath.Join(wd, "config", "config.ini"), filepath.Join(wd, "config", "prod.ini"), false},
+	}
+	for _, c := range cases {
+		if got := samePath(c.a, c.b); got != c.want {
+			t.Errorf("samePath(%q, %q) = %v, want %v", c.a, c.b, got, c.want)
+		}
+	}
+}
+
+//apply时拷贝的文件必须与计划中源文件的SHA-256一致
+func TestCopyFileCheckPlanned(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	srcFile := filepath.Join(src, "b.dll")
+	os.WriteFile(srcFile, []byte("reviewed"), 0644)
+	_, sum, err := fileDigest(srcFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	up := NewUpdateProgram()
+	up.source_sums = map[string]string{"b.dll": sum}
+	if err := up.copyFile("1001", dst, srcFile); err != nil {
+		t.Fatalf("copy reviewed file: %s", err)
+	}
+
+	os.WriteFile(srcFile, []byte("swapped after review"), 0644)
+	if err := up.copyFile("1001", dst, srcFile); err == nil {
+		t.Error("copy of a swapped source file should fail")
+	}
+
+	os.WriteFile(filepath.Join(src, "c.dll"), []byte("new"), 0644)
+	if err := up.copyFile("1001", dst, filepath.Join(src, "c.dll")); err == nil {
+		t.Error("copy of a file not in the plan should fail")
+	}
+}
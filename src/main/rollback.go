@@ -0,0 +1,360 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+)
+
+//备份文件名:原文件名前缀(作者日期_序号).后缀,括号中的部分为标记,同一次更新备份的文件标记相同
+var backupNameReg = regexp.MustCompile(`^(.+)\(([^()]*?)(\d{8})_(\d+)\)(\.[^.()]+)$`)
+
+//Rollback_Mid_Word 回滚前备份当前文件时加在作者后面的标记,不指定-to时不会回滚到这些备份
+const Rollback_Mid_Word = "-rollback-"
+
+//BackupSet 目标目录下同一次更新备份的文件,一定包含目标exe的备份
+type BackupSet struct {
+	Tag      string            //备份文件名括号中的标记
+	Date     string            //备份的日期
+	Index    int               //同一天的第几次备份
+	Exe      string            //目标exe的备份文件
+	Version  string            //目标exe备份的版本号
+	Files    map[string]string //原文件名 + 备份文件路径
+	Rollback bool              //rollback命令回滚前备份的当前文件
+	Missing  []string          //目标目录中存在但不在备份中的源文件,还原后会是混合的版本
+}
+
+//Stamp 备份的日期和序号,可以作为rollback -to的参数
+func (bs *BackupSet) Stamp() string {
+	return bs.Date + "_" + strconv.Itoa(bs.Index)
+}
+
+func (bs *BackupSet) String() string {
+	return bs.Stamp() + " version " + bs.Version + " (" + bs.Tag + ", " + strconv.Itoa(len(bs.Files)) + " files)"
+}
+
+//Kind 备份的来源及是否完整,用于输出
+func (bs *BackupSet) Kind() string {
+	kind := "update"
+	if bs.Rollback {
+		kind = "rollback"
+	}
+	if len(bs.Missing) > 0 {
+		kind += ", incomplete: missing " + strings.Join(bs.Missing, " ")
+	}
+	return kind
+}
+
+//CheckComplete 检查备份是否包含目标目录中现有的每个源文件(names为源文件名,不包括源目录的主程序)
+//旧版本的更新程序每个文件单独编号,同一次更新的exe和dll可能被分到不同的备份中
+func (bs *BackupSet) CheckComplete(dir string, names []string) {
+	PthSep := string(os.PathSeparator)
+	bs.Missing = nil
+	for _, name := range names {
+		if _, ok := bs.Files[name]; !ok && FileIsExisted(dir+PthSep+name) {
+			bs.Missing = append(bs.Missing, name)
+		}
+	}
+}
+
+//FindBackupSets 获取目标目录下的所有备份并按标记分组,只保留包含目标exe备份的,最近的在前
+func FindBackupSets(dir, exeName string) ([]*BackupSet, error) {
+	PthSep := string(os.PathSeparator)
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	sets := make(map[string]*BackupSet, 0)
+	for _, fi := range fis {
+		m := backupNameReg.FindStringSubmatch(fi.Name())
+		if fi.IsDir() || m == nil {
+			continue
+		}
+		tag := m[2] + m[3] + "_" + m[4]
+		bs, ok := sets[tag]
+		if !ok {
+			index, _ := strconv.Atoi(m[4])
+			bs = &BackupSet{Tag: tag, Date: m[3], Index: index, Files: make(map[string]string, 0), Rollback: strings.HasSuffix(m[2], Rollback_Mid_Word)}
+			sets[tag] = bs
+		}
+		name := m[1] + m[5]
+		bs.Files[name] = dir + PthSep + fi.Name()
+		if strings.EqualFold(name, exeName) {
+			bs.Exe = bs.Files[name]
+		}
+	}
+
+	list := make([]*BackupSet, 0, len(sets))
+	for _, bs := range sets {
+		if len(bs.Exe) == 0 {
+			continue
+		}
+		fi := fileInfo{FilePath: bs.Exe}
+		fi.GetExeVersion()
+		bs.Version = fi.Version
+		list = append(list, bs)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Date != list[j].Date {
+			return list[i].Date > list[j].Date
+		}
+		if list[i].Index != list[j].Index {
+			return list[i].Index > list[j].Index
+		}
+		return list[i].Tag < list[j].Tag
+	})
+	return list, nil
+}
+
+//PickBackupSet 按版本号或备份的日期(20240101或20240101_0)选择最近的一次备份
+//to为空时为最近的一次更新时的备份,跳过回滚前的备份,连续回滚时每次回到更早的版本
+func PickBackupSet(sets []*BackupSet, to string) (*BackupSet, error) {
+	for _, bs := range sets {
+		if len(to) == 0 && !bs.Rollback || len(to) > 0 && (to == bs.Version || to == bs.Date || to == bs.Stamp()) {
+			return bs, nil
+		}
+	}
+
+	if len(sets) == 0 {
+		return nil, fmt.Errorf("no backup found")
+	}
+	available := make([]string, 0, len(sets))
+	for _, bs := range sets {
+		available = append(available, bs.Stamp()+" "+bs.Version)
+	}
+	return nil, fmt.Errorf("no backup matches %s, available: %s", to, strings.Join(available, ", "))
+}
+
+//LoadServers 按servers(格式与update_serverid相同)加载需要回滚的目标,不受update_serverid和not_update_serverid的限制
+func (up *UpdateProgram) LoadServers(upcfg *UpdateCfg, servers string) error {
+	selector, err := NewTargetSelector(servers, "")
+	if err != nil {
+		return err
+	}
+
+	upcfg.mu.RLock()
+	defer upcfg.mu.RUnlock()
+
+	up.author = upcfg.author
+	up.source_exe_file = upcfg.source_dir + string(os.PathSeparator) + upcfg.source_exe_name
+	up.loadSourceFiles(upcfg)
+	up.target_dir = make(map[string]string, 0)
+	up.target_exe_file = make(map[string]string, 0)
+	up.target_service = make(map[string]string, 0)
+	up.target_display = make(map[string]string, 0)
+
+	list, err := DiscoverBy(upcfg, selector)
+	if err != nil {
+		return err
+	}
+	for _, d := range list {
+		if d.Status != Discover_Selected {
+			if d.Status == Discover_Ambiguous || d.Status == Discover_Dir_Missing {
+				logU.ErrorDoo("serverID:", d.ServerID, d.Status, d.Reason, "skip it")
+			}
+			continue
+		}
+		up.target_dir[d.ServerID] = d.Dir
+		up.target_exe_file[d.ServerID] = d.Exe
+		up.target_service[d.ServerID] = d.Service
+		up.target_display[d.ServerID] = d.Display
+		up.order = append(up.order, d.ServerID)
+	}
+	sort.SliceStable(up.order, func(i, j int) bool {
+		return lessServerID(up.order[i], up.order[j])
+	})
+
+	return nil
+}
+
+//RollbackTarget 把目标还原为to指定的备份(为空时为最近一次更新时的备份),先备份当前的文件再还原整个备份,校验版本号后重启服务
+//备份不完整时拒绝回滚,force为true时只记录警告,任何一步失败时撤销本次的操作,目标回到回滚前的文件
+func (up *UpdateProgram) RollbackTarget(k, to string, force bool) error {
+	sets, err := up.backupSets(k)
+	if err != nil {
+		return err
+	}
+	set, err := PickBackupSet(sets, to)
+	if err != nil {
+		return err
+	}
+	if len(set.Missing) > 0 {
+		if !force {
+			return fmt.Errorf("backup %s is incomplete, missing %s, it may be made by an older updater that numbered each file separately, "+
+				"restore it by hand or run rollback with -force to restore only the files in the backup", set.Stamp(), strings.Join(set.Missing, " "))
+		}
+		up.log(k).ErrorDoo("backup", set.Stamp(), "is incomplete, missing", strings.Join(set.Missing, " "), "restore it anyway because of -force")
+	}
+	up.log(k).InfoDoo("roll back to", set)
+
+	start := up.mark()
+	err = up.restoreSet(k, set)
+	if err == nil {
+		err = up.verifyVersion(k, set.Version)
+	}
+	if err == nil && !up.restart(k) {
+		err = &updateError{Action_Restart, fmt.Errorf("service %s is not running, please check: %s", up.target_service[k], up.target_exe_file[k])}
+	}
+	if err != nil {
+		up.log(k).ErrorDoo("roll back to", set.Stamp(), err)
+		up.rollback(k, start, err.(*updateError).op == Action_Restart)
+		return err
+	}
+
+	up.log(k).InfoDoo("roll back to", set.Stamp(), "success version is:", set.Version)
+	return nil
+}
+
+//backupSets 获取目标的所有备份并检查是否完整,最近的在前
+func (up *UpdateProgram) backupSets(k string) ([]*BackupSet, error) {
+	exeName, _ := GetFileNameByPath(up.target_exe_file[k])
+	sets, err := FindBackupSets(up.target_dir[k], exeName)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(up.source_file))
+	for _, name := range sortedKeys(up.source_file) {
+		if up.source_file[name] != up.source_exe_file {
+			names = append(names, name)
+		}
+	}
+	for _, bs := range sets {
+		bs.CheckComplete(up.target_dir[k], names)
+	}
+	return sets, nil
+}
+
+//restoreSet 把当前的文件备份后,把备份中的所有文件重命名为原来的文件名
+func (up *UpdateProgram) restoreSet(k string, set *BackupSet) error {
+	PthSep := string(os.PathSeparator)
+	v := up.target_dir[k]
+	names := sortedKeys(set.Files)
+
+	live := make([]string, 0, len(names))
+	for _, name := range names {
+		if FileIsExisted(v + PthSep + name) {
+			live = append(live, name)
+		}
+	}
+	backNames := GetNotDittoBackupNames(v, live, up.author+Rollback_Mid_Word)
+	for _, name := range live {
+		if err := up.rename(k, Action_Backup, v+PthSep+name, backNames[name]); err != nil {
+			return &updateError{Action_Backup, err}
+		}
+	}
+
+	for _, name := range names {
+		if err := up.rename(k, Action_Restore, set.Files[name], v+PthSep+name); err != nil {
+			return &updateError{Action_Restore, err}
+		}
+	}
+	return nil
+}
+
+//RunRollback 把-server指定的目标还原为之前的备份并重启服务,配置了components时每个组件都会回滚
+func RunRollback(args []string) {
+	cf := NewCmdFlags(Cmd_Rollback)
+	servers := cf.String("server", "", "the serverIDs to roll back separated by commas, same format as update_serverid, required")
+	to := cf.String("to", "", "the exe version (like 1.0.0.1) or backup date (like 20240101 or 20240101_0) to restore, "+
+		"default is the latest backup made by update (the backups made by rollback itself are skipped, so each rollback goes one version back)")
+	list := cf.Bool("list", false, "only list the backups of the servers")
+	force := cf.Bool("force", false, "restore an incomplete backup (some source files are not in it) instead of refusing")
+	cf.Parse(args)
+
+	if len(*servers) == 0 {
+		logU.ErrorDoo("flag -server is required")
+		return
+	}
+	updateCfg, err := cf.LoadCfg()
+	if err != nil {
+		logU.ErrorDoo(err)
+		WaitQuit("**Rollback refused please fix the config first**")
+		return
+	}
+
+	var successList, failList []string
+	found := false
+	for _, comp := range updateCfg.Components() {
+		name := comp.Name()
+		if len(name) > 0 {
+			logU.InfoDoo("Rollback component:", name)
+			name += ": "
+		}
+
+		updateProgram := NewUpdateProgram()
+		if err := updateProgram.LoadServers(comp, *servers); err != nil {
+			failList = append(failList, name+err.Error())
+			continue
+		}
+		for _, k := range updateProgram.order {
+			found = true
+			if *list {
+				PrintBackupSets(os.Stdout, name+updateProgram.target_display[k], updateProgram, k)
+				continue
+			}
+			if err := updateProgram.RollbackTarget(k, *to, *force); err != nil {
+				failList = append(failList, name+updateProgram.target_display[k]+": "+err.Error())
+			} else {
+				successList = append(successList, name+updateProgram.target_display[k])
+			}
+		}
+	}
+
+	if !found {
+		logU.ErrorDoo("no serverID matches -server", *servers)
+		return
+	}
+	if *list {
+		return
+	}
+
+	str := "\r\n"
+	for _, s := range successList {
+		str += s + "\r\n"
+	}
+	logU.InfoDoo("Rollback Success List:", str)
+
+	str = "\r\n"
+	for _, s := range failList {
+		str += s + "\r\n"
+	}
+	logU.InfoDoo("Rollback Fail List:", str)
+
+	WaitQuit("**Rollback end please check the log to confirm rollback result**")
+}
+
+//PrintBackupSets 输出目标目录下的所有备份,最近的在前,标出回滚前的备份和不完整的备份以及不指定-to时回滚到哪个
+func PrintBackupSets(w io.Writer, title string, up *UpdateProgram, k string) {
+	fmt.Fprintf(w, "\r\n%s (%s):\r\n", title, up.target_dir[k])
+	sets, err := up.backupSets(k)
+	if err != nil {
+		fmt.Fprintf(w, "  %s\r\n", err)
+		return
+	}
+	if len(sets) == 0 {
+		fmt.Fprintf(w, "  no backup found\r\n")
+		return
+	}
+
+	latest, _ := PickBackupSet(sets, "")
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "  backup\tversion\ttag\tkind\tfiles\r\n")
+	for _, bs := range sets {
+		mark := " "
+		if bs == latest {
+			mark = "*"
+		}
+		fmt.Fprintf(tw, "%s %s\t%s\t%s\t%s\t%s\r\n", mark, bs.Stamp(), bs.Version, bs.Tag, bs.Kind(), strings.Join(sortedKeys(bs.Files), " "))
+	}
+	tw.Flush()
+	fmt.Fprintf(w, "  * default backup to roll back to without -to\r\n")
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+)
+
+//touch 在目录下创建多个文件
+func touch(t *testing.T, dir string, names ...string) {
+	for _, name := range names {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+//不指定-to时跳过rollback自己创建的备份,第二次回滚回到更早的版本而不是刚回滚掉的版本
+func TestPickBackupSetSkipsRollback(t *testing.T) {
+	dir := t.TempDir()
+	touch(t, dir, "GW.exe", "a.dll",
+		"GW(j20240101_0).exe", "a(j20240101_0).dll",
+		"GW(j20240102_0).exe", "a(j20240102_0).dll",
+		"GW(j"+Rollback_Mid_Word+"20240103_0).exe", "a(j"+Rollback_Mid_Word+"20240103_0).dll")
+
+	sets, err := FindBackupSets(dir, "GW.exe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sets) != 3 || !sets[0].Rollback || sets[1].Rollback {
+		t.Fatalf("FindBackupSets = %v", sets)
+	}
+	bs, err := PickBackupSet(sets, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bs.Stamp() != "20240102_0" {
+		t.Errorf("PickBackupSet default = %s, want 20240102_0", bs.Stamp())
+	}
+	if bs, err := PickBackupSet(sets, "20240103"); err != nil || !bs.Rollback {
+		t.Errorf("PickBackupSet -to 20240103 = %v, %v, want the rollback backup", bs, err)
+	}
+}
+
+//旧版本每个文件单独编号,同一次更新的dll不在exe的备份中
+func TestBackupSetCheckComplete(t *testing.T) {
+	dir := t.TempDir()
+	touch(t, dir, "GW.exe", "a.dll", "b.dll",
+		"GW(j20240101_0).exe", "a(j20240101_0).dll", "b(j20240101_0).dll",
+		"GW(j20240102_0).exe", "a(j20240102_1).dll", "b(j20240102_2).dll")
+
+	sets, err := FindBackupSets(dir, "GW.exe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sets) != 2 {
+		t.Fatalf("FindBackupSets = %v", sets)
+	}
+	names := []string{"a.dll", "b.dll", "c.dll"}
+	for _, bs := range sets {
+		bs.CheckComplete(dir, names)
+	}
+	if want := []string{"a.dll", "b.dll"}; !reflect.DeepEqual(sets[0].Missing, want) {
+		t.Errorf("%s missing = %v, want %v", sets[0].Stamp(), sets[0].Missing, want)
+	}
+	if len(sets[1].Missing) != 0 {
+		t.Errorf("%s missing = %v, want none", sets[1].Stamp(), sets[1].Missing)
+	}
+}
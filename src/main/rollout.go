@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/chai2010/winsvc"
+
+)
+
+//Health_Check_Timeout 健康检查命令的超时时间
+const Health_Check_Timeout = 60 * time.Second
+
+//Command_Wait_Delay 命令超时结束进程树后,最多再等待输出管道关闭的时间
+const Command_Wait_Delay = 5 * time.Second
+
+//健康检查命令中可以使用的变量
+var healthCheckVars = []string{"server_id", "service_name", "display_name", "server_dir", "target_exe", "exe_version"}
+
+//RolloutStages 把按更新顺序排好的serverID分成多个阶段:第一个阶段为金丝雀(满足canary的serverID或者前canaryCount个)
+//其余的每batchSize个为一个阶段,batchSize为0时剩下的为一个阶段,都没有配置时只有一个阶段
+//配置的金丝雀没有选中任何目标或者选中了所有目标时返回错误,避免不经过金丝雀和健康检查直接更新全部
+func RolloutStages(order []string, canary string, canaryCount, batchSize int) ([][]string, error) {
+	terms, err := ParseSelectorTerms(canary)
+	if err != nil {
+		return nil, err
+	}
+	if canaryCount > 0 && canaryCount >= len(order) {
+		return nil, fmt.Errorf("canary_count %d selects all the %d targets to update, no stage is left to gate by the canary", canaryCount, len(order))
+	}
+
+	first := make([]string, 0)
+	rest := make([]string, 0)
+	for _, id := range order {
+		matched := len(terms) == 0 && len(first) < canaryCount
+		for _, term := range terms {
+			if term.Match(id) {
+				matched = true
+				break
+			}
+		}
+		if matched {
+			first = append(first, id)
+		} else {
+			rest = append(rest, id)
+		}
+	}
+
+	if len(terms) > 0 && len(first) == 0 {
+		return nil, fmt.Errorf("canary_serverid %s matches none of the %d targets to update", canary, len(order))
+	}
+	if len(terms) > 0 && len(rest) == 0 {
+		return nil, fmt.Errorf("canary_serverid %s matches all the %d targets to update, no stage is left to gate by the canary", canary, len(order))
+	}
+
+	stages := make([][]string, 0)
+	if len(first) > 0 {
+		stages = append(stages, first)
+	}
+	for len(rest) > 0 {
+		n := len(rest)
+		if batchSize > 0 && batchSize < n {
+			n = batchSize
+		}
+		stages = append(stages, rest[:n])
+		rest = rest[n:]
+	}
+	return stages, nil
+}
+
+//healthGate 两个阶段之间的健康检查:刚结束的阶段中有目标更新失败(failed)或者没有一个目标更新成功(stageUpdated)时不通过
+//否则等待soak_time后,检查所有阶段已更新(updated)的每个目标的服务仍在运行,exe的版本号为exe_version
+//并且配置了health_check时命令执行成功,有任何一个目标不通过时返回false,预演时不做检查
+func (up *UpdateProgram) healthGate(stage int, stageUpdated, failed, updated []string) bool {
+	if up.dry_run {
+		return true
+	}
+
+	if len(failed) > 0 {
+		logU.ErrorDoo("Health gate after stage", stage, "fail,", len(failed), "targets of the stage failed to update:", strings.Join(failed, ","))
+		return false
+	}
+	if len(stageUpdated) == 0 {
+		logU.ErrorDoo("Health gate after stage", stage, "fail, no target of the stage is updated")
+		return false
+	}
+
+	if up.soak_time > 0 {
+		logU.InfoDoo("Stage", stage, "done, soak", up.soak_time, "before the health gate")
+		time.Sleep(up.soak_time)
+	}
+
+	passed := true
+	for _, k := range updated {
+		if err := up.checkHealth(k); err != nil {
+			up.log(k).ErrorDoo("health gate fail:", err)
+			passed = false
+		}
+	}
+	if passed {
+		logU.InfoDoo("Health gate after stage", stage, "passed,", len(updated), "updated targets checked")
+	}
+	return passed
+}
+
+//checkHealth 检查一个已更新的目标是否健康
+func (up *UpdateProgram) checkHealth(k string) error {
+	if status, err := winsvc.QueryService(up.target_service[k]); err != nil {
+		return fmt.Errorf("query service %s fail: %s", up.target_service[k], err)
+	} else if status != "Running" {
+		return fmt.Errorf("service %s is %s", up.target_service[k], status)
+	}
+
+	fi := fileInfo{FilePath: up.target_exe_file[k]}
+	fi.GetExeVersion()
+	if fi.Version != up.exe_version {
+		return fmt.Errorf("version of %s is %s not %s", up.target_exe_file[k], fi.Version, up.exe_version)
+	}
+
+	if len(up.health_check) > 0 {
+		return RunCommand(ExpandName(up.health_check, up.targetVars(k)), nil, Health_Check_Timeout)
+	}
+	return nil
+}
+
+//targetVars 目标的变量,用于健康检查命令
+func (up *UpdateProgram) targetVars(k string) map[string]string {
+	return map[string]string{
+		"server_id":    k,
+		"service_name": up.target_service[k],
+		"display_name": up.target_display[k],
+		"server_dir":   up.target_dir[k],
+		"target_exe":   up.target_exe_file[k],
+		"exe_version":  up.exe_version,
+	}
+}
+
+//RunCommand 通过cmd /C执行命令行,env为在当前环境变量之外追加的环境变量,超时或者退出码不为0时返回错误,错误中带有命令的输出
+func RunCommand(cmdline string, env []string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	//命令行原样交给cmd,避免参数被再次加上引号
+	cmd := exec.CommandContext(ctx, "cmd")
+	cmd.SysProcAttr = &syscall.SysProcAttr{CmdLine: "/C " + cmdline}
+	//超时时只结束cmd的话,它启动的脚本,powershell等子进程仍持有输出管道,读取输出会一直等到子进程退出
+	//所以结束整个进程树,子进程没有结束时最多再等待Command_Wait_Delay就不再读取输出
+	cmd.Cancel = func() error { return killProcessTree(cmd.Process) }
+	cmd.WaitDelay = Command_Wait_Delay
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	out, err := cmd.CombinedOutput()
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("command %s timeout after %s", cmdline, timeout)
+	}
+	if err != nil {
+		return fmt.Errorf("command %s fail: %s %s", cmdline, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+//killProcessTree 用taskkill结束进程及其启动的所有子进程,失败时只结束该进程
+func killProcessTree(p *os.Process) error {
+	if err := exec.Command("taskkill", "/T", "/F", "/PID", strconv.Itoa(p.Pid)).Run(); err != nil {
+		return p.Kill()
+	}
+	return nil
+}
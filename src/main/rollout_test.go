@@ -0,0 +1,79 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+)
+
+func TestRolloutStages(t *testing.T) {
+	order := []string{"1001", "1002", "1003", "1004", "1005"}
+	cases := []struct {
+		canary      string
+		canaryCount int
+		batchSize   int
+		want        [][]string
+	}{
+		{"", 0, 0, [][]string{order}},
+		{"1003", 0, 0, [][]string{{"1003"}, {"1001", "1002", "1004", "1005"}}},
+		{"", 2, 2, [][]string{{"1001", "1002"}, {"1003", "1004"}, {"1005"}}},
+		{"", 4, 0, [][]string{{"1001", "1002", "1003", "1004"}, {"1005"}}},
+		{"", 0, 3, [][]string{{"1001", "1002", "1003"}, {"1004", "1005"}}},
+	}
+	for _, c := range cases {
+		got, err := RolloutStages(order, c.canary, c.canaryCount, c.batchSize)
+		if err != nil {
+			t.Fatalf("RolloutStages(%q, %d, %d): %s", c.canary, c.canaryCount, c.batchSize, err)
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("RolloutStages(%q, %d, %d) = %v, want %v", c.canary, c.canaryCount, c.batchSize, got, c.want)
+		}
+	}
+}
+
+//配置的金丝雀没有选中目标或选中了所有目标时不能静默地跳过金丝雀和健康检查
+func TestRolloutStagesCanaryError(t *testing.T) {
+	order := []string{"1001", "1002"}
+	cases := []struct {
+		name        string
+		canary      string
+		canaryCount int
+	}{
+		{"canary_serverid matching nothing", "2001", 0},
+		{"canary_serverid matching every target", "10*", 0},
+		{"canary_count equal to the targets", "", 2},
+		{"canary_count more than the targets", "", 3},
+	}
+	for _, c := range cases {
+		if _, err := RolloutStages(order, c.canary, c.canaryCount, 1); err == nil {
+			t.Errorf("%s should fail", c.name)
+		}
+	}
+}
+
+//阶段中有目标更新失败或没有目标更新成功时不检查服务就不通过
+func TestHealthGateStageResult(t *testing.T) {
+	up := NewUpdateProgram()
+	if up.healthGate(1, nil, []string{"1001"}, nil) {
+		t.Error("gate should fail when every target of the stage failed")
+	}
+	if up.healthGate(1, nil, nil, []string{"1001"}) {
+		t.Error("gate should fail when no target of the stage is updated")
+	}
+	if up.healthGate(1, []string{"1002"}, []string{"1003"}, []string{"1002"}) {
+		t.Error("gate should fail when any target of the stage failed")
+	}
+}
+
+//命令启动的子进程超时后仍在运行时,RunCommand也要在超时后返回
+func TestRunCommandTimeout(t *testing.T) {
+	start := time.Now()
+	err := RunCommand("ping -n 30 127.0.0.1", nil, time.Second)
+	if err == nil {
+		t.Error("a command longer than the timeout should fail")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second+Command_Wait_Delay+5*time.Second {
+		t.Errorf("RunCommand returned after %s, the timeout is not enforced", elapsed)
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+)
+
+//目标的状态
+const (
+	Status_Up_To_Date = "up-to-date"    //所有文件与源文件一致
+	Status_Outdated   = "outdated"      //目标exe的版本号与源文件不同,还没有更新
+	Status_Drifted    = "drifted"       //目标exe的版本号一致但有文件内容不同,一般是被手动修改过
+	Status_Missing    = "missing files" //有源文件在目标目录中不存在
+)
+
+//单个文件的比较结果
+const (
+	File_Same    = "same"
+	File_Missing = "missing"
+	File_Version = "version differs"
+	File_Content = "content differs"
+)
+
+//FileState 源文件与目标文件的比较结果,版本号只有主程序(目标exe)才有
+type FileState struct {
+	Name          string
+	Source        string
+	Target        string
+	State         string
+	SourceSize    int64
+	TargetSize    int64
+	SourceVersion string
+	TargetVersion string
+}
+
+func (fs *FileState) String() string {
+	switch fs.State {
+	case File_Version:
+		return fs.Name + " (" + fs.TargetVersion + " -> " + fs.SourceVersion + ")"
+	case File_Content:
+		return fmt.Sprintf("%s (size %d -> %d)", fs.Name, fs.TargetSize, fs.SourceSize)
+	}
+	return fs.Name
+}
+
+//TargetStatus 一个目标的状态及其每个文件的比较结果
+type TargetStatus struct {
+	ServerID string
+	Service  string
+	Status   string
+	Files    []*FileState
+}
+
+//fileDigest 获取文件大小和SHA-256
+func fileDigest(path string) (int64, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return 0, "", err
+	}
+	return size, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+//exeFileVersion 获取主程序的版本号,与verifyVersion一样只读取目标exe,其它的dll不一定有版本信息
+func exeFileVersion(path string) string {
+	fi := fileInfo{FilePath: path}
+	fi.GetExeVersion()
+	return fi.Version
+}
+
+//compareFile 比较源文件和目标文件,源文件的大小,SHA-256和版本号由调用方缓存,源文件有版本号(主程序)时才读取目标的版本号
+func compareFile(fs *FileState, sourceSum string) {
+	if !FileIsExisted(fs.Target) {
+		fs.State = File_Missing
+		return
+	}
+
+	size, sum, err := fileDigest(fs.Target)
+	if err != nil {
+		logU.ErrorDoo("Read file", fs.Target, "fail:", err)
+	}
+	fs.TargetSize = size
+	if len(fs.SourceVersion) > 0 {
+		fs.TargetVersion = exeFileVersion(fs.Target)
+	}
+
+	switch {
+	case err == nil && sum == sourceSum:
+		fs.State = File_Same
+	case fs.SourceVersion != fs.TargetVersion:
+		fs.State = File_Version
+	default:
+		fs.State = File_Content
+	}
+}
+
+//Status 比较每个目标中的文件与源文件,按更新顺序返回每个目标的状态,不会修改任何文件
+func (up *UpdateProgram) Status() []*TargetStatus {
+	PthSep := string(os.PathSeparator)
+	exeName, _ := GetFileNameByPath(up.source_exe_file)
+
+	//源文件只计算一次
+	sums := make(map[string]string, 0)
+	sources := make(map[string]*FileState, 0)
+	for _, name := range sortedKeys(up.source_file) {
+		size, sum, err := fileDigest(up.source_file[name])
+		if err != nil {
+			logU.ErrorDoo("Read file", up.source_file[name], "fail:", err)
+		}
+		sums[name] = sum
+		sources[name] = &FileState{Name: name, Source: up.source_file[name], SourceSize: size}
+		if name == exeName {
+			sources[name].SourceVersion = exeFileVersion(up.source_file[name])
+		}
+	}
+
+	list := make([]*TargetStatus, 0, len(up.order))
+	for _, k := range up.order {
+		ts := &TargetStatus{ServerID: k, Service: up.target_service[k]}
+		for _, name := range sortedKeys(up.source_file) {
+			fs := *sources[name]
+			fs.Target = up.target_dir[k] + PthSep + name
+			//主程序拷贝后会重命名为目标exe
+			if name == exeName {
+				fs.Target = up.target_exe_file[k]
+			}
+			compareFile(&fs, sums[name])
+			ts.Files = append(ts.Files, &fs)
+		}
+
+		ts.Status = targetStatus(ts.Files)
+		list = append(list, ts)
+	}
+
+	return list
+}
+
+//targetStatus 按文件的比较结果获取目标的状态,缺失 > 版本不同 > 内容不同
+func targetStatus(files []*FileState) string {
+	states := make(map[string]bool, 0)
+	for _, fs := range files {
+		states[fs.State] = true
+	}
+
+	switch {
+	case states[File_Missing]:
+		return Status_Missing
+	case states[File_Version]:
+		return Status_Outdated
+	case states[File_Content]:
+		return Status_Drifted
+	}
+	return Status_Up_To_Date
+}
+
+//RunStatus 比较所有目标中的文件与源文件,输出每个目标是否需要更新
+func RunStatus(args []string) {
+	cf := NewCmdFlags(Cmd_Status)
+	files := cf.Bool("files", false, "also print the state of every file")
+	cf.Parse(args)
+
+	updateCfg, err := cf.LoadCfg()
+	if err != nil {
+		logU.ErrorDoo(err)
+		return
+	}
+
+	for _, comp := range updateCfg.Components() {
+		if name := comp.Name(); len(name) > 0 {
+			fmt.Fprintf(os.Stdout, "\r\n==== component: %s ====\r\n", name)
+		}
+
+		updateProgram := NewUpdateProgram()
+		if err := updateProgram.Load(comp); err != nil {
+			continue
+		}
+		PrintStatus(os.Stdout, updateProgram.Status(), *files)
+	}
+}
+
+//PrintStatus 按表格输出每个目标的状态和不一致的文件,showFiles为true时输出每个文件的比较结果
+func PrintStatus(w io.Writer, list []*TargetStatus, showFiles bool) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "serverID\tservice\tstatus\tdetail\r\n")
+	count := make(map[string]int, 0)
+	for _, ts := range list {
+		details := make([]string, 0)
+		for _, fs := range ts.Files {
+			if fs.State != File_Same {
+				details = append(details, fs.State+": "+fs.String())
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\r\n", ts.ServerID, ts.Service, ts.Status, strings.Join(details, "; "))
+		count[ts.Status]++
+
+		if showFiles {
+			for _, fs := range ts.Files {
+				fmt.Fprintf(tw, "\t\t  %s\t%s %s\r\n", fs.State, fs.Target, fs.TargetVersion)
+			}
+		}
+	}
+	tw.Flush()
+
+	summary := make([]string, 0)
+	for _, status := range []string{Status_Up_To_Date, Status_Outdated, Status_Drifted, Status_Missing} {
+		if count[status] > 0 {
+			summary = append(summary, fmt.Sprintf("%s %d", status, count[status]))
+		}
+	}
+	fmt.Fprintf(w, "\r\ntotal %d: %s\r\n", len(list), strings.Join(summary, ", "))
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+)
+
+//只有主程序读取版本号,没有版本信息的dll只比较内容
+func TestCompareFile(t *testing.T) {
+	dir := t.TempDir()
+	touch(t, dir, "a.dll", "b.dll")
+	os.WriteFile(filepath.Join(dir, "c.dll"), []byte("a.dll"), 0644)
+	_, sum, err := fileDigest(filepath.Join(dir, "a.dll"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		target string
+		want   string
+	}{
+		{"c.dll", File_Same},
+		{"b.dll", File_Content},
+		{"d.dll", File_Missing},
+	}
+	for _, c := range cases {
+		fs := &FileState{Name: "a.dll", Source: filepath.Join(dir, "a.dll"), Target: filepath.Join(dir, c.target)}
+		compareFile(fs, sum)
+		if fs.State != c.want || len(fs.TargetVersion) > 0 {
+			t.Errorf("compare with %s = %s version %q, want %s without version", c.target, fs.State, fs.TargetVersion, c.want)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+)
+
+//选择条件的类型
+const (
+	Term_Exact = "exact" //与目录名完全相同,如 1001
+	Term_Glob  = "glob"  //通配符,如 10*
+	Term_Regex = "regex" //re:开头的正则,会匹配整个目录名,如 re:10\d{2}
+	Term_Range = "range" //数字范围(包含两端),如 1000-1999
+)
+
+//Term_Regex_Prefix 正则选择条件的前缀
+const Term_Regex_Prefix = "re:"
+
+var rangeTermReg = regexp.MustCompile(`^(\d+)-(\d+)$`)
+
+//SelectorTerm 目标选择条件
+type SelectorTerm struct {
+	Text string
+	Kind string
+	re   *regexp.Regexp
+	low  uint64
+	high uint64
+}
+
+func (st *SelectorTerm) String() string {
+	return st.Text + "(" + st.Kind + ")"
+}
+
+//Match 判断目录名是否满足该条件
+func (st *SelectorTerm) Match(name string) bool {
+	switch st.Kind {
+	case Term_Glob:
+		ok, _ := path.Match(st.Text, name)
+		return ok
+	case Term_Regex:
+		return st.re.MatchString(name)
+	case Term_Range:
+		id, err := strconv.ParseUint(name, 10, 64)
+		return err == nil && id >= st.low && id <= st.high
+	}
+	return st.Text == name
+}
+
+//ParseSelectorTerms 解析逗号隔开的选择条件列表,正则中不能包含逗号
+func ParseSelectorTerms(list string) ([]*SelectorTerm, error) {
+	terms := make([]*SelectorTerm, 0)
+	for _, text := range strings.Split(list, ",") {
+		text = strings.TrimSpace(text)
+		if len(text) == 0 {
+			continue
+		}
+
+		term := &SelectorTerm{Text: text, Kind: Term_Exact}
+		if strings.HasPrefix(text, Term_Regex_Prefix) {
+			expr := strings.TrimPrefix(text, Term_Regex_Prefix)
+			if _, err := regexp.Compile(expr); err != nil {
+				return nil, fmt.Errorf("bad regex %s: %s", text, err)
+			}
+			term.Kind, term.re = Term_Regex, regexp.MustCompile("^(?:"+expr+")$")
+		} else if strings.ContainsAny(text, "*?[") {
+			if _, err := path.Match(text, ""); err != nil {
+				return nil, fmt.Errorf("bad glob %s: %s", text, err)
+			}
+			term.Kind = Term_Glob
+		} else if m := rangeTermReg.FindStringSubmatch(text); m != nil {
+			term.Kind = Term_Range
+			term.low, _ = strconv.ParseUint(m[1], 10, 64)
+			term.high, _ = strconv.ParseUint(m[2], 10, 64)
+			if term.low > term.high {
+				return nil, fmt.Errorf("bad range %s: start is greater than end", text)
+			}
+		}
+		terms = append(terms, term)
+	}
+
+	return terms, nil
+}
+
+//TargetSelector 目标serverID选择器,include为空表示全部选中,同时满足时exclude优先
+type TargetSelector struct {
+	include []*SelectorTerm
+	exclude []*SelectorTerm
+}
+
+//NewTargetSelector 根据update_serverid和not_update_serverid创建选择器
+func NewTargetSelector(include, exclude string) (*TargetSelector, error) {
+	ts := &TargetSelector{}
+	var err error
+	if ts.include, err = ParseSelectorTerms(include); err != nil {
+		return nil, fmt.Errorf("update_serverid %s", err)
+	}
+	if ts.exclude, err = ParseSelectorTerms(exclude); err != nil {
+		return nil, fmt.Errorf("not_update_serverid %s", err)
+	}
+	return ts, nil
+}
+
+//Select 判断serverID目录是否需要更新,同时返回原因
+func (ts *TargetSelector) Select(name string) (bool, string) {
+	if ts == nil {
+		return true, "no selector"
+	}
+
+	for _, term := range ts.exclude {
+		if term.Match(name) {
+			return false, "excluded by not_update_serverid " + term.String()
+		}
+	}
+
+	if len(ts.include) == 0 {
+		return true, "included (update_serverid is empty)"
+	}
+
+	for _, term := range ts.include {
+		if term.Match(name) {
+			return true, "included by update_serverid " + term.String()
+		}
+	}
+
+	return false, "not matched by update_serverid"
+}
+
+//checkSelector 校验选择条件列表
+func checkSelector(value string) string {
+	if msg := checkCommaList(value); msg != "" {
+		return msg
+	}
+	if _, err := ParseSelectorTerms(value); err != nil {
+		return err.Error()
+	}
+	return ""
+}
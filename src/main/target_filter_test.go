@@ -0,0 +1,81 @@
+package main
+
+import (
+	"testing"
+
+)
+
+func TestSelectorTermMatch(t *testing.T) {
+	cases := []struct {
+		term string
+		kind string
+		name string
+		want bool
+	}{
+		{"1001", Term_Exact, "1001", true},
+		{"1001", Term_Exact, "10011", false},
+		{"1001", Term_Exact, "100", false},
+		{"10*", Term_Glob, "1001", true},
+		{"10*", Term_Glob, "2100", false},
+		{"10?1", Term_Glob, "1001", true},
+		{"10?1", Term_Glob, "10011", false},
+		{`re:10\d{2}`, Term_Regex, "1001", true},
+		{`re:10\d{2}`, Term_Regex, "10011", false},
+		{`re:10\d{2}`, Term_Regex, "a1001", false},
+		{"1000-1999", Term_Range, "1000", true},
+		{"1000-1999", Term_Range, "1999", true},
+		{"1000-1999", Term_Range, "2000", false},
+		{"1000-1999", Term_Range, "10a", false},
+	}
+	for _, c := range cases {
+		terms, err := ParseSelectorTerms(c.term)
+		if err != nil || len(terms) != 1 {
+			t.Fatalf("ParseSelectorTerms(%q) = %v, %v", c.term, terms, err)
+		}
+		if terms[0].Kind != c.kind {
+			t.Errorf("%q kind = %s, want %s", c.term, terms[0].Kind, c.kind)
+		}
+		if got := terms[0].Match(c.name); got != c.want {
+			t.Errorf("%q.Match(%q) = %v, want %v", c.term, c.name, got, c.want)
+		}
+	}
+}
+
+func TestParseSelectorTermsError(t *testing.T) {
+	for _, list := range []string{"re:10(", "10[", "2000-1000"} {
+		if _, err := ParseSelectorTerms(list); err == nil {
+			t.Errorf("ParseSelectorTerms(%q) should fail", list)
+		}
+	}
+}
+
+//not_update_serverid原来用strings.Contains匹配,serverID是其它ID的子串时会被误排除
+func TestTargetSelectorSelect(t *testing.T) {
+	cases := []struct {
+		include string
+		exclude string
+		name    string
+		want    bool
+	}{
+		{"", "1001", "1001", false},
+		{"", "1001", "100", true},
+		{"", "1001", "10", true},
+		{"", "1001", "10011", true},
+		{"", "222222222222,444444444444", "2222", true},
+		{"1001,1002", "", "1001", true},
+		{"1001,1002", "", "100", false},
+		{"10*", "1005", "1005", false},
+		{"10*", "1005", "1006", true},
+		{"1000-1999", "1500-1599", "1550", false},
+		{"1000-1999", "1500-1599", "1600", true},
+	}
+	for _, c := range cases {
+		ts, err := NewTargetSelector(c.include, c.exclude)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, reason := ts.Select(c.name); got != c.want {
+			t.Errorf("include %q exclude %q Select(%q) = %v (%s), want %v", c.include, c.exclude, c.name, got, reason, c.want)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+)
+
+//Layout_Default 默认的目标目录布局:target_dir下的serverID目录中名称包含server_type的子目录
+const Layout_Default = "{target_dir}/{server_id}/*{server_type}*"
+
+//Layout_Server_ID 目录布局中必须包含的变量,捕获的值即serverID
+const Layout_Server_ID = "server_id"
+
+var layoutVarReg = regexp.MustCompile(`\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+//layoutSegment 目录布局中的一级目录,re为nil时是固定的目录名
+type layoutSegment struct {
+	text string
+	re   *regexp.Regexp
+}
+
+//TargetLayout 目标目录布局,使用/或\分隔每一级目录,每一级可以包含通配符*和?以及命名变量{name}
+//{target_dir}和{server_type}会替换为对应配置项的值,其它变量匹配任意目录名并作为目标的变量,{server_id}必须存在
+//例如 {target_dir}/{server_id}/*MT{server_type}* 或 {target_dir}/{region}/{server_id}
+type TargetLayout struct {
+	Text     string
+	segments []*layoutSegment
+	idIndex  int //捕获server_id的那一级目录
+}
+
+//ParseTargetLayout 解析目录布局,fixed为固定的变量及其值
+//卷名(如 C: 或 UNC路径的 \\server\share)作为第一级目录保持不变,不能按分隔符拆开
+func ParseTargetLayout(layout string, fixed map[string]string) (*TargetLayout, error) {
+	text := layout
+	for name, value := range fixed {
+		text = strings.Replace(text, "{"+name+"}", value, -1)
+	}
+
+	tl := &TargetLayout{Text: layout}
+	if vol := filepath.VolumeName(text); len(vol) > 0 && !strings.ContainsAny(vol, "{}*?") {
+		tl.segments = append(tl.segments, &layoutSegment{text: vol})
+		text = text[len(vol):]
+	}
+	names := make(map[string]bool, 0)
+	for i, part := range strings.Split(strings.Replace(text, "\\", "/", -1), "/") {
+		if len(part) == 0 && (i > 0 || len(tl.segments) > 0) {
+			continue
+		}
+		if !strings.ContainsAny(part, "{}*?") {
+			tl.segments = append(tl.segments, &layoutSegment{text: part})
+			continue
+		}
+
+		expr, last := "^", 0
+		for _, m := range layoutVarReg.FindAllStringSubmatchIndex(part, -1) {
+			expr += globExpr(part[last:m[0]])
+			name := part[m[2]:m[3]]
+			if names[name] {
+				return nil, fmt.Errorf("layout %s: variable {%s} is used more than once", layout, name)
+			}
+			names[name] = true
+			if name == Layout_Server_ID {
+				tl.idIndex = len(tl.segments)
+			}
+			expr += "(?P<" + name + ">.+?)"
+			last = m[1]
+		}
+		rest := part[last:]
+		if strings.ContainsAny(rest, "{}") {
+			return nil, fmt.Errorf("layout %s: bad variable in %s, name must be letters, digits or _", layout, part)
+		}
+		expr += globExpr(rest) + "$"
+
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("layout %s: %s", layout, err)
+		}
+		tl.segments = append(tl.segments, &layoutSegment{text: part, re: re})
+	}
+
+	if !names[Layout_Server_ID] {
+		return nil, fmt.Errorf("layout %s: must contain {%s}", layout, Layout_Server_ID)
+	}
+	return tl, nil
+}
+
+//globExpr 把包含通配符*和?的文本转换为正则
+func globExpr(text string) string {
+	expr := ""
+	for _, c := range text {
+		switch c {
+		case '*':
+			expr += ".*"
+		case '?':
+			expr += "."
+		default:
+			expr += regexp.QuoteMeta(string(c))
+		}
+	}
+	return expr
+}
+
+//Target 按目录布局找到的目录,Vars为布局中捕获的变量(包括server_id)
+type Target struct {
+	ServerID string
+	Dir      string
+	Vars     map[string]string
+}
+
+//Scan 按目录布局查找所有匹配的目录,结果按目录排序,同一个serverID可能匹配多个目录
+func (tl *TargetLayout) Scan() ([]*Target, error) {
+	return tl.walk(tl.segments)
+}
+
+//ScanServerIDs 只查找到serverID所在的那一级目录,用于找出serverID目录下没有匹配的目录的情况
+func (tl *TargetLayout) ScanServerIDs() ([]*Target, error) {
+	return tl.walk(tl.segments[:tl.idIndex+1])
+}
+
+//walk 逐级遍历目录,返回最后一级匹配的目录
+func (tl *TargetLayout) walk(segments []*layoutSegment) ([]*Target, error) {
+	PthSep := string(os.PathSeparator)
+	found := []*Target{{Vars: make(map[string]string, 0)}}
+
+	for i, seg := range segments {
+		next := make([]*Target, 0)
+		for _, t := range found {
+			if seg.re == nil {
+				if i == 0 {
+					t.Dir = seg.text
+				} else {
+					t.Dir += PthSep + seg.text
+				}
+				next = append(next, t)
+				continue
+			}
+
+			dir, err := ioutil.ReadDir(t.Dir)
+			if err != nil {
+				//第一个需要遍历的目录(一般是target_dir)读取失败时直接返回错误
+				if len(found) == 1 && len(t.Vars) == 0 {
+					return nil, err
+				}
+				logU.ErrorDoo(err)
+				continue
+			}
+			for _, fi := range dir {
+				m := seg.re.FindStringSubmatch(fi.Name())
+				if !fi.IsDir() || m == nil {
+					continue
+				}
+				vars := make(map[string]string, len(t.Vars)+1)
+				for k, v := range t.Vars {
+					vars[k] = v
+				}
+				for j, name := range seg.re.SubexpNames() {
+					if len(name) > 0 {
+						vars[name] = m[j]
+					}
+				}
+				next = append(next, &Target{Dir: t.Dir + PthSep + fi.Name(), Vars: vars})
+			}
+		}
+		found = next
+	}
+
+	targets := make([]*Target, 0, len(found))
+	for _, t := range found {
+		if fi, err := os.Stat(t.Dir); err == nil && fi.IsDir() {
+			t.ServerID = t.Vars[Layout_Server_ID]
+			targets = append(targets, t)
+		}
+	}
+	sort.Slice(targets, func(i, j int) bool { return targets[i].Dir < targets[j].Dir })
+	return targets, nil
+}
+
+//NewTargetLayout 按配置中的target_layout创建目录布局,为空时使用Layout_Default
+func NewTargetLayout(layout, target_dir, server_type string) (*TargetLayout, error) {
+	if len(layout) == 0 {
+		layout = Layout_Default
+	}
+	return ParseTargetLayout(layout, map[string]string{"target_dir": target_dir, "server_type": server_type})
+}
+
+//checkTargetLayout 校验目录布局的格式
+func checkTargetLayout(value string) string {
+	if _, err := NewTargetLayout(value, "target_dir", "server_type"); err != nil {
+		return err.Error()
+	}
+	return ""
+}
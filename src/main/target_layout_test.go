@@ -0,0 +1,145 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+
+)
+
+//mkdirs 在临时目录下创建多个目录,返回临时目录
+func mkdirs(t *testing.T, dirs ...string) string {
+	root := t.TempDir()
+	for _, dir := range dirs {
+		if err := os.MkdirAll(filepath.Join(root, filepath.FromSlash(dir)), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+func TestParseTargetLayoutError(t *testing.T) {
+	for _, layout := range []string{
+		"{target_dir}/*{server_type}*",
+		"{target_dir}/{server_id}/{server_id}",
+		"{target_dir}/{server_id}/{bad-name}",
+	} {
+		if _, err := NewTargetLayout(layout, "d", "5"); err == nil {
+			t.Errorf("NewTargetLayout(%q) should fail", layout)
+		}
+	}
+}
+
+//target_dir为UNC路径时\\server\share不能被拆开,否则会变成当前盘符下的\server\share
+func TestParseTargetLayoutVolume(t *testing.T) {
+	if runtime.GOOS != "windows" {
+		t.Skip("volume names only exist on windows")
+	}
+	cases := []struct {
+		targetDir string
+		want      []string
+	}{
+		{`\\server\share\trade`, []string{`\\server\share`, "trade", "", "MT5"}},
+		{`//server/share`, []string{`//server/share`, "", "MT5"}},
+		{`E:\trade`, []string{"E:", "trade", "", "MT5"}},
+		{`trade`, []string{"trade", "", "MT5"}},
+	}
+	for _, c := range cases {
+		tl, err := NewTargetLayout("{target_dir}/{server_id}/MT{server_type}", c.targetDir, "5")
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make([]string, 0)
+		for _, seg := range tl.segments {
+			if seg.re != nil {
+				got = append(got, "")
+			} else {
+				got = append(got, seg.text)
+			}
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("target_dir %s segments = %q, want %q", c.targetDir, got, c.want)
+		}
+	}
+}
+
+func TestTargetLayoutScanCaptures(t *testing.T) {
+	root := mkdirs(t, "eu/1001", "eu/1002", "us/2001", "us/readme")
+	os.WriteFile(filepath.Join(root, "eu", "1003"), []byte("not a dir"), 0644)
+
+	tl, err := NewTargetLayout("{target_dir}/{region}/{server_id}", root, "5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	targets, err := tl.Scan()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{"1001": "eu", "1002": "eu", "2001": "us", "readme": "us"}
+	if len(targets) != len(want) {
+		t.Fatalf("Scan found %d targets, want %d", len(targets), len(want))
+	}
+	for _, target := range targets {
+		if target.Vars["region"] != want[target.ServerID] {
+			t.Errorf("serverID %s region = %q, want %q", target.ServerID, target.Vars["region"], want[target.ServerID])
+		}
+		if target.Dir != filepath.Join(root, target.Vars["region"], target.ServerID) {
+			t.Errorf("serverID %s dir = %s", target.ServerID, target.Dir)
+		}
+	}
+}
+
+func TestTargetLayoutScanPattern(t *testing.T) {
+	root := mkdirs(t, "1001/MT5_Gateway", "1001/MT4_Gateway", "1002/MT4_Gateway", "x1003/MT5")
+
+	tl, err := NewTargetLayout("{target_dir}/{server_id}/MT{server_type}*", root, "5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	targets, err := tl.Scan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]string, 0)
+	for _, target := range targets {
+		got[target.ServerID] = filepath.Base(target.Dir)
+	}
+	if len(got) != 2 || got["1001"] != "MT5_Gateway" || got["x1003"] != "MT5" {
+		t.Errorf("Scan = %v", got)
+	}
+}
+
+func TestDiscoverLayoutAmbiguous(t *testing.T) {
+	root := mkdirs(t, "1001/MT5a", "1001/MT5b", "1002/MT4", "1003/MT5", "10031/MT5")
+
+	tl, err := NewTargetLayout(Layout_Default, root, "5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	selector, err := NewTargetSelector("", "10031")
+	if err != nil {
+		t.Fatal(err)
+	}
+	list, err := DiscoverLayout(tl, nil, selector)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{
+		"1001":  Discover_Ambiguous,
+		"1002":  Discover_No_Type_Dir,
+		"1003":  Discover_Selected,
+		"10031": Discover_Excluded,
+	}
+	if len(list) != len(want) {
+		t.Fatalf("DiscoverLayout found %d serverIDs, want %d", len(list), len(want))
+	}
+	for _, d := range list {
+		if d.Status != want[d.ServerID] {
+			t.Errorf("serverID %s status = %s (%s), want %s", d.ServerID, d.Status, d.Reason, want[d.ServerID])
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+
+)
+
+//服务名,目标exe名和显示名的默认模板,与原来的命名方式一致
+const (
+	Name_Service_Default = "{server_prefix}{server_id}"
+	Name_Exe_Default     = "{service_name}.exe"
+	Name_Display_Default = "{service_name}"
+)
+
+//名称模板中固定可用的变量,目录布局中的命名变量也可以使用
+var nameTemplateVars = []string{"server_id", "server_type", "server_prefix", "target_dir", "dir_name"}
+
+//TargetNames 按模板生成每个目标的服务名,目标exe名和显示名,模板中的变量写作{name}
+type TargetNames struct {
+	Service    string
+	Exe        string
+	Display    string
+	ServerType string
+	Prefix     string
+	TargetDir  string
+}
+
+//NewTargetNames 按配置创建名称模板,调用方需持有upcfg的锁
+func NewTargetNames(upcfg *UpdateCfg) *TargetNames {
+	return &TargetNames{Service: upcfg.service_name, Exe: upcfg.target_exe_name, Display: upcfg.display_name,
+		ServerType: upcfg.server_type, Prefix: upcfg.server_prefix, TargetDir: upcfg.target_dir}
+}
+
+//Resolve 生成目标的服务名和显示名并返回目标exe文件名,Service和exe不为空(来自服务器清单)时保留
+func (tn *TargetNames) Resolve(d *Discovery, exe string) string {
+	vars := make(map[string]string, len(d.Vars)+6)
+	for k, v := range d.Vars {
+		vars[k] = v
+	}
+	vars["server_id"] = d.ServerID
+	vars["server_type"] = tn.ServerType
+	vars["server_prefix"] = tn.Prefix
+	vars["target_dir"] = tn.TargetDir
+	vars["dir_name"] = filepath.Base(d.Dir)
+
+	if len(d.Service) == 0 {
+		d.Service = ExpandName(tn.Service, vars)
+	}
+	vars["service_name"] = d.Service
+	if len(exe) == 0 {
+		exe = ExpandName(tn.Exe, vars)
+	}
+	d.Display = ExpandName(tn.Display, vars)
+	return exe
+}
+
+//ExpandName 替换模板中的变量,不认识的变量保持原样
+func ExpandName(tpl string, vars map[string]string) string {
+	return layoutVarReg.ReplaceAllStringFunc(tpl, func(m string) string {
+		if v, ok := vars[m[1:len(m)-1]]; ok {
+			return v
+		}
+		return m
+	})
+}
+
+//checkNameTemplate 校验名称模板中的变量格式,变量是否存在由checkRelation校验
+func checkNameTemplate(value string) string {
+	rest := layoutVarReg.ReplaceAllString(value, "")
+	if strings.ContainsAny(rest, "{}") {
+		return "bad variable, must be {name} with letters, digits or _"
+	}
+	if strings.ContainsAny(rest, `\/:*?"<>|`) {
+		return "must not contain any of \\ / : * ? \" < > |"
+	}
+	return ""
+}
+
+//unknownNameVars 获取名称模板中不能使用的变量,known为额外可用的变量
+func unknownNameVars(tpl string, known ...string) []string {
+	return unknownVars(tpl, append(append([]string{}, nameTemplateVars...), known...))
+}
+
+//unknownVars 获取模板中不在vars中的变量
+func unknownVars(tpl string, vars []string) []string {
+	allowed := make(map[string]bool, 0)
+	for _, name := range vars {
+		allowed[name] = true
+	}
+
+	unknown := make([]string, 0)
+	for _, m := range layoutVarReg.FindAllStringSubmatch(tpl, -1) {
+		if !allowed[m[1]] {
+			unknown = append(unknown, "{"+m[1]+"}")
+		}
+	}
+	return unknown
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+)
+
+//更新顺序的策略,相同时都按serverID排序
+const (
+	Order_ServerID       = "serverid"       //按serverID排序,纯数字的在前并按数值大小,其余的按字符串
+	Order_Priority       = "priority"       //按update_priority中第一个匹配的选择条件的顺序,都不匹配的排在最后
+	Order_Tag            = "tag"            //按服务器清单中priority=N标签的N从小到大,没有该标签的排在最后
+	Order_Least_Critical = "least_critical" //按服务器清单中critical=N标签的N从小到大,critical标签等同于critical=9,没有的为0
+)
+
+//服务器清单中用于排序的标签
+const (
+	Tag_Priority       = "priority="
+	Tag_Critical       = "critical"
+	Critical_Max_Level = 9
+)
+
+//UpdateOrders 支持的更新顺序策略
+var UpdateOrders = []string{Order_ServerID, Order_Priority, Order_Tag, Order_Least_Critical}
+
+//OrderTargets 按策略对需要更新的serverID排序,priority为update_priority选择条件列表,tags为服务器清单中的标签
+func OrderTargets(ids []string, strategy, priority string, tags map[string][]string) ([]string, error) {
+	terms, err := ParseSelectorTerms(priority)
+	if err != nil {
+		return nil, err
+	}
+
+	rank := func(id string) int {
+		switch strategy {
+		case Order_Priority:
+			for i, term := range terms {
+				if term.Match(id) {
+					return i
+				}
+			}
+			return len(terms)
+		case Order_Tag:
+			for _, tag := range tags[id] {
+				if strings.HasPrefix(tag, Tag_Priority) {
+					if n, err := strconv.Atoi(strings.TrimPrefix(tag, Tag_Priority)); err == nil {
+						return n
+					}
+				}
+			}
+			return int(^uint(0) >> 1)
+		case Order_Least_Critical:
+			return criticalLevel(tags[id])
+		}
+		return 0
+	}
+
+	ordered := append([]string{}, ids...)
+	ranks := make(map[string]int, len(ordered))
+	for _, id := range ordered {
+		ranks[id] = rank(id)
+	}
+	sort.SliceStable(ordered, func(i, j int) bool {
+		if ranks[ordered[i]] != ranks[ordered[j]] {
+			return ranks[ordered[i]] < ranks[ordered[j]]
+		}
+		return lessServerID(ordered[i], ordered[j])
+	})
+	return ordered, nil
+}
+
+//criticalLevel 获取标签中的重要程度,critical=N为N,critical为Critical_Max_Level,没有为0
+func criticalLevel(tags []string) int {
+	level := 0
+	for _, tag := range tags {
+		if tag == Tag_Critical {
+			level = Critical_Max_Level
+		} else if strings.HasPrefix(tag, Tag_Critical+"=") {
+			if n, err := strconv.Atoi(strings.TrimPrefix(tag, Tag_Critical+"=")); err == nil {
+				level = n
+			}
+		}
+	}
+	return level
+}
+
+//lessServerID 比较serverID,纯数字的排在前面并按数值大小(相同时按字符串,如007和7),其余的按字符串
+//数字和非数字分开比较保证排序的传递性,否则会出现 9 < 10 < 1a < 9
+func lessServerID(a, b string) bool {
+	na, errA := strconv.ParseUint(a, 10, 64)
+	nb, errB := strconv.ParseUint(b, 10, 64)
+	switch {
+	case errA == nil && errB == nil:
+		if na != nb {
+			return na < nb
+		}
+	case errA == nil:
+		return true
+	case errB == nil:
+		return false
+	}
+	return a < b
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+)
+
+func TestLessServerID(t *testing.T) {
+	cases := []struct {
+		a, b string
+		want bool
+	}{
+		{"9", "10", true},
+		{"10", "9", false},
+		{"10", "1a", true},
+		{"1a", "9", false},
+		{"9", "1a", true},
+		{"007", "7", true},
+		{"7", "007", false},
+		{"7", "7", false},
+		{"1a", "1b", true},
+		{"abc", "1a", false},
+	}
+	for _, c := range cases {
+		if got := lessServerID(c.a, c.b); got != c.want {
+			t.Errorf("lessServerID(%q, %q) = %v, want %v", c.a, c.b, got, c.want)
+		}
+	}
+}
+
+//混合数字和非数字时比较必须满足传递性,任意输入顺序排序的结果都相同
+func TestLessServerIDTransitive(t *testing.T) {
+	ids := []string{"9", "10", "1a", "007", "7", "100", "abc", "1b", "A1", "0"}
+	for _, a := range ids {
+		for _, b := range ids {
+			for _, c := range ids {
+				if lessServerID(a, b) && lessServerID(b, c) && !lessServerID(a, c) {
+					t.Fatalf("not transitive: %s < %s < %s but not %s < %s", a, b, c, a, c)
+				}
+			}
+		}
+	}
+
+	want := []string{"0", "007", "7", "9", "10", "100", "1a", "1b", "A1", "abc"}
+	for i := 0; i < len(ids); i++ {
+		list := append(append([]string{}, ids[i:]...), ids[:i]...)
+		sort.Slice(list, func(x, y int) bool { return lessServerID(list[x], list[y]) })
+		if !reflect.DeepEqual(list, want) {
+			t.Fatalf("sorted %v, want %v", list, want)
+		}
+	}
+}
+
+func TestOrderTargets(t *testing.T) {
+	ids := []string{"1003", "2001", "1001", "1002", "3001"}
+	tags := map[string][]string{
+		"1001": {"priority=2", "critical"},
+		"1002": {"priority=1", "critical=3"},
+		"2001": {"priority=1"},
+	}
+	cases := []struct {
+		strategy string
+		priority string
+		want     []string
+	}{
+		{Order_ServerID, "", []string{"1001", "1002", "1003", "2001", "3001"}},
+		{Order_Priority, "3001,20*", []string{"3001", "2001", "1001", "1002", "1003"}},
+		{Order_Tag, "", []string{"1002", "2001", "1001", "1003", "3001"}},
+		{Order_Least_Critical, "", []string{"1003", "2001", "3001", "1002", "1001"}},
+	}
+	for _, c := range cases {
+		got, err := OrderTargets(ids, c.strategy, c.priority, tags)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("OrderTargets %s %q = %v, want %v", c.strategy, c.priority, got, c.want)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -8,6 +9,7 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 	"unsafe"
@@ -27,24 +29,65 @@ const (
 type UpdateProgram struct {
 	author           string
 	exe_version      string
-	source_file      map[string]string //文件名 + 文件完整路径
-	source_exe_file  string            //源文件exe路径
-	target_dir       map[string]string //serverID + 目标文件路径
-	target_exe_file  map[string]string //serverID + 目标exe路径
+	source_file      map[string]string            //文件名 + 文件完整路径
+	source_exe_file  string                       //源文件exe路径
+	target_dir       map[string]string            //serverID + 目标文件路径
+	target_vars      map[string]map[string]string //serverID + 目录布局中捕获的变量
+	target_exe_file  map[string]string            //serverID + 目标exe路径
+	target_service   map[string]string            //serverID + 服务名
+	target_display   map[string]string            //serverID + 显示名
+	target_tags      map[string][]string          //serverID + 服务器清单中的标签
 	server_type      string
 	server_prefix    string
 	backup_file_num  int
 	update_stop_flag int
+	parallel         int               //同时更新的目标个数
+	order            []string          //按update_order排序后的serverID
+	stages           [][]string        //分阶段更新时每个阶段的serverID,第一个为金丝雀
+	stage_base       int               //resume时已经更新过的阶段数,阶段号从它之后开始
+	resume_updated   []string          //resume时之前已经更新成功的目标,之后的健康检查同样检查它们
+	stage_updated    []string          //resume时中断的阶段中之前已更新成功的目标,与第一个阶段一起检查
+	stage_failed     []string          //resume时中断的阶段中之前更新失败的目标
+	soak_time        time.Duration     //阶段之间等待的时长
+	health_check     string            //阶段之间健康检查的命令
+	hooks            map[string]string //钩子名 + 命令
+	hook_timeout     time.Duration     //钩子命令的超时时间
+	stopped          bool              //因错误停止了后续的更新
+	dry_run          bool              //预演模式,只记录将要执行的操作
+	actions          []*UpdateAction   //执行(预演时为将要执行)的操作
+	pending          map[string]int64  //预演时当前目标还没有实际发生的文件变化,文件路径 + 修改时间,-1表示文件已不存在
+	journal          *Journal          //更新日志,为nil时不记录
+	source_sums      map[string]string //apply时计划中源文件的SHA-256,文件名 + SHA-256,为nil时不校验
+	mu               sync.Mutex        //并行更新时保护stopped和actions
 }
 
 func NewUpdateProgram() *UpdateProgram {
 	return &UpdateProgram{}
 }
 
+//loadSourceFiles 根据源目录配置得出需要更新哪些文件,调用方需持有upcfg的锁
+func (up *UpdateProgram) loadSourceFiles(upcfg *UpdateCfg) {
+	up.source_file = make(map[string]string, 0)
+	suffix := strings.Split(upcfg.source_file_suffix, ",")
+	if filelist, err := GetFiles(upcfg.source_dir, suffix, true); err == nil {
+		for _, v := range filelist {
+			if str, err := GetFileNameByPath(v); err == nil {
+				up.source_file[str] = v
+			} else {
+				logU.ErrorDoo(err)
+			}
+		}
+	}
+}
+
 //根据配置进行加载
 func (up *UpdateProgram) Load(upcfg *UpdateCfg) error {
 	PthSep := string(os.PathSeparator)
 
+	//常驻模式下配置可能被重新加载,读取期间加读锁
+	upcfg.mu.RLock()
+	defer upcfg.mu.RUnlock()
+
 	up.author = upcfg.author
 	up.exe_version = upcfg.exe_version
 	up.server_type = upcfg.server_type
@@ -52,148 +95,442 @@ func (up *UpdateProgram) Load(upcfg *UpdateCfg) error {
 	up.source_exe_file = upcfg.source_dir + PthSep + upcfg.source_exe_name
 	up.backup_file_num = upcfg.backup_file_num
 	up.update_stop_flag = upcfg.update_stop_flag
+	up.parallel = upcfg.update_parallel
+	up.soak_time = upcfg.soak_time
+	up.health_check = upcfg.health_check
+	up.hooks = map[string]string{
+		Hook_Pre_Backup:   upcfg.hook_pre_backup,
+		Hook_Post_Copy:    upcfg.hook_post_copy,
+		Hook_Pre_Restart:  upcfg.hook_pre_restart,
+		Hook_Post_Restart: upcfg.hook_post_restart,
+		Hook_On_Failure:   upcfg.hook_on_failure,
+	}
+	up.hook_timeout = upcfg.hook_timeout
 
-	up.source_file = make(map[string]string, 0)
 	up.target_dir = make(map[string]string, 0)
+	up.target_vars = make(map[string]map[string]string, 0)
 	up.target_exe_file = make(map[string]string, 0)
+	up.target_service = make(map[string]string, 0)
+	up.target_display = make(map[string]string, 0)
+	up.target_tags = make(map[string][]string, 0)
 
-	//根据源目录配置得出需要更新哪些文件
-	suffix := strings.Split(upcfg.source_file_suffix, ",")
-	if filelist, err := GetFiles(upcfg.source_dir, suffix, true); err == nil {
-		for _, v := range filelist {
-			if str, err := GetFileNameByPath(v); err == nil {
-				up.source_file[str] = v
-			} else {
-				logU.ErrorDoo(err)
+	up.loadSourceFiles(upcfg)
+
+	//根据服务器清单或目标目录布局得出需要更新的目标,并记录选中或跳过的原因
+	list, err := DiscoverTargets(upcfg)
+	if err != nil {
+		logU.ErrorDoo(err)
+		return err
+	}
+
+	ids := make([]string, 0, len(list))
+	for _, d := range list {
+		logUEx.InfoDoo("serverID:", d.ServerID, d.Status, d.Reason)
+		if d.Status != Discover_Selected {
+			if d.Status == Discover_Ambiguous || d.Status == Discover_Dir_Missing {
+				logU.ErrorDoo("serverID:", d.ServerID, d.Status, d.Reason, "skip it")
 			}
+			continue
 		}
+		up.target_dir[d.ServerID] = d.Dir
+		up.target_vars[d.ServerID] = d.Vars
+		up.target_exe_file[d.ServerID] = d.Exe
+		up.target_service[d.ServerID] = d.Service
+		up.target_display[d.ServerID] = d.Display
+		up.target_tags[d.ServerID] = d.Tags
+		ids = append(ids, d.ServerID)
 	}
 
+	//更新顺序在更新开始前打印出来
+	if up.order, err = OrderTargets(ids, upcfg.update_order, upcfg.update_priority, up.target_tags); err != nil {
+		logU.ErrorDoo(err)
+		return err
+	}
 	updateList := "\r\n"
-	//根据目标目录配置得出需要更新的目标目录文件夹
-	up.target_dir, _ = GetCurDirList(upcfg.target_dir, upcfg.server_type, upcfg.not_update_serverid)
-	for k, v := range up.target_dir {
-		up.target_exe_file[k] = v + PthSep + up.server_prefix + k + ".exe"
-		updateList += k + "\r\n"
+	for i, k := range up.order {
+		updateList += strconv.Itoa(i+1) + ". " + k + "\r\n"
 	}
+	logU.InfoDoo("Cur Need To Update ServerID List (update_order "+upcfg.update_order+"):", updateList)
 
-	logU.InfoDoo("Cur Need To Update ServerID List:", updateList)
+	//配置了金丝雀或每批的个数时分阶段更新,阶段之间进行健康检查
+	if up.stages, err = RolloutStages(up.order, upcfg.canary_serverid, upcfg.canary_count, upcfg.batch_size); err != nil {
+		logU.ErrorDoo(err)
+		return err
+	}
+	if len(up.stages) > 1 {
+		stageList := "\r\n"
+		for i, stage := range up.stages {
+			stageList += "stage " + strconv.Itoa(i+1) + ": " + strings.Join(stage, ",") + "\r\n"
+		}
+		logU.InfoDoo("Rollout Stages (soak_time "+upcfg.soak_time.String()+"):", stageList)
+	}
+	hookList := ""
+	for _, hook := range HookNames {
+		if len(up.hooks[hook]) > 0 {
+			hookList += hook + ": " + up.hooks[hook] + "\r\n"
+		}
+	}
+	if len(hookList) > 0 {
+		logU.InfoDoo("Hooks (timeout "+up.hook_timeout.String()+"):", "\r\n"+hookList)
+	}
 
 	return nil
 }
 
-//StartUpdate 更新文件开始,如果某一个文件更新失败即停止更新后续的，如果某个文件更新后启动失败由标志update_stop_flag决定是否停止更新后续的
+//StartUpdate 按阶段和更新顺序开始更新目标,最多同时更新up.parallel个,每个目标的更新是完整的,任何一步失败都会还原该目标的所有文件
+//版本校验失败时停止更新后续的，如果某个文件更新后启动失败由标志update_stop_flag决定是否停止更新后续的,正在更新的目标会继续完成
+//分阶段更新时每个阶段结束后等待soak_time并进行健康检查,不通过时停止更新后续的阶段,预演时逐个更新,保证记录的操作顺序固定
 func (up *UpdateProgram) StartUpdate() (successServerName, failServerName []string) {
+	stages := up.stages
+	if len(stages) == 0 {
+		stages = [][]string{up.order}
+	}
 
-	PthSep := string(os.PathSeparator)
-	var success int = 0
-	var fail int = 0
-	//轮询一遍目标目录,进行文件更新
-	for k, v := range up.target_dir {
-
-		if _, ok := up.target_exe_file[k]; !ok {
-			logU.InfoDoo("serverID:", k, " not exist correspond exe file")
-			fail++
-			failServerName = append(failServerName, up.server_prefix+k)
-			logU.InfoDoo("Update progress[success:", success, "fail:", fail, "total:", len(up.target_dir))
-			continue
+	results := &updateResults{errs: make(map[string]error, 0), total: len(up.order)}
+	updated := append(make([]string, 0), up.resume_updated...)
+	for i, stage := range stages {
+		if up.isStopped() {
+			break
+		}
+		n := up.stage_base + i + 1
+		if len(stages) > 1 || up.stage_base > 0 {
+			logU.InfoDoo("Rollout stage", n, "of", up.stage_base+len(stages), "start:", strings.Join(stage, ","))
+		}
+		up.journal.Stage(n, stage)
+		up.runStage(stage, results)
+
+		//resume时第一个阶段可能是中断的阶段剩下的目标,健康检查包括之前已经结束的目标
+		stageUpdated := make([]string, 0)
+		failed := make([]string, 0)
+		if i == 0 {
+			stageUpdated = append(stageUpdated, up.stage_updated...)
+			failed = append(failed, up.stage_failed...)
 		}
-		curName := up.target_exe_file[k]
-		renName := GetNotDittoFileName(v, up.server_prefix+k, up.author, ".exe")
-
-		//如果目标的exe文件存在就先进行重命名
-		if b := FileIsExisted(curName); b {
-			err := os.Rename(curName, renName)
-			if err != nil {
-				logU.ErrorDoo("Rename file err: ", err, " curName:", curName, " desName:", renName)
-				fail++
-				failServerName = append(failServerName, up.server_prefix+k)
-				logU.InfoDoo("Update progress[success:", success, "fail:", fail, "total:", len(up.target_dir))
-				continue
+		for _, k := range stage {
+			if err, ok := results.errs[k]; ok && err == nil {
+				stageUpdated = append(stageUpdated, k)
+				updated = append(updated, k)
+			} else if ok {
+				failed = append(failed, k)
 			}
 		}
 
-		//拷贝文件
-		for name, f := range up.source_file {
-			//除了exe文件外先把目标的文件进行重命名
-			if !strings.HasSuffix(f, ".exe") {
-				rn := GetNotDittoFileName(v, GetFileNamePrefixByFile(name), up.author, GetFileNameSuffixByPath(name))
-				cn := v + PthSep + name
-				if b := FileIsExisted(cn); b {
-					err := os.Rename(cn, rn)
-					if err != nil {
-						logU.ErrorDoo("Rename file err: ", err, " curName:", curName, " desName:", rn)
-					}
-				}
+		if up.isStopped() || i == len(stages)-1 {
+			break
+		}
+		passed := up.healthGate(n, stageUpdated, failed, updated)
+		up.journal.Gate(n, passed)
+		if !passed {
+			logU.ErrorDoo("Health gate after stage", n, "fail, rollout halted, the rest", len(stages)-i-1, "stages are not updated")
+			up.halt()
+			break
+		}
+	}
+
+	//存储更新成功和失败的程序的显示名,按更新顺序
+	for _, k := range up.order {
+		if err, ok := results.errs[k]; !ok {
+			continue
+		} else if err == nil {
+			successServerName = append(successServerName, up.target_display[k])
+		} else {
+			failServerName = append(failServerName, up.target_display[k])
+		}
+	}
+	return
+}
+
+//updateResults 所有阶段的更新结果,serverID + 错误(成功为nil),需要持有up.mu
+type updateResults struct {
+	errs    map[string]error
+	success int
+	fail    int
+	total   int
+}
+
+//runStage 更新一个阶段的目标,最多同时更新up.parallel个,预演时逐个更新
+func (up *UpdateProgram) runStage(stage []string, results *updateResults) {
+	parallel := up.parallel
+	if parallel < 1 || up.dry_run {
+		parallel = 1
+	}
 
-				//最多保留up.backup_file_num个会覆盖的目的文件,多余的删除
-				if dstName, err := GetFileNameByPath(f); err == nil {
-					ClearBackupFileByMatch(v, dstName, []string{GetFileNameSuffixByPath(name)}, up.backup_file_num)
+	jobs := make(chan string)
+	var wg sync.WaitGroup
+	for w := 0; w < parallel; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for k := range jobs {
+				if up.isStopped() {
+					continue
 				}
 
+				err := up.updateTarget(k)
+				up.mu.Lock()
+				results.errs[k] = err
+				if err == nil {
+					results.success++
+				} else {
+					results.fail++
+					if up.stopOn(k, err) {
+						up.stopped = true
+					}
+				}
+				up.log(k).InfoDoo("Update progress[success:", results.success, "fail:", results.fail, "total:", results.total)
+				up.mu.Unlock()
 			}
+		}()
+	}
 
-			err := CopyFile(v, f)
-			if err != nil {
-				logU.ErrorDoo("CopyFile file err: ", err, " srcPath:", f, " desDir:", v)
-				continue
-			}
+	//按更新顺序分配目标,停止后不再分配
+	for _, k := range stage {
+		if up.isStopped() {
+			break
 		}
+		jobs <- k
+	}
+	close(jobs)
+	wg.Wait()
+}
 
-		//拷贝文件结束后需要对exe程序进行重命名为对应服务的名字
-		if exeName, err := GetFileNameByPath(up.source_exe_file); err == nil {
-			dstExePath := v + PthSep + exeName
-			err = os.Rename(dstExePath, curName)
-			if err != nil {
-				logU.ErrorDoo("Rename file err: ", err, " curName:", dstExePath, " desName:", curName)
-				fail++
-				failServerName = append(failServerName, up.server_prefix+k)
-				logU.InfoDoo("Update progress[success:", success, "fail:", fail, "total:", len(up.target_dir))
-				continue
-			}
+//stopOn 目标更新失败后是否需要停止更新后续的目标,不是updateError的错误不知道是哪一步失败,停止更新
+func (up *UpdateProgram) stopOn(k string, err error) bool {
+	var ue *updateError
+	if !errors.As(err, &ue) {
+		up.log(k).ErrorDoo("unexpected error", err, "stop the update")
+		return true
+	}
+	switch ue.op {
+	case Action_Verify:
+		up.log(k).ErrorDoo("please check exe_version is match")
+		return true
+	case Action_Restart, Action_Hook:
+		if up.update_stop_flag == Update_Continue {
+			return false
+		} else if up.update_stop_flag != Update_Stop {
+			up.log(k).ErrorDoo("don't know update_stop_flag", up.update_stop_flag)
+		}
+		return true
+	}
+	return false
+}
+
+//halt 停止后续的更新,正在更新的目标会继续完成
+func (up *UpdateProgram) halt() {
+	up.mu.Lock()
+	up.stopped = true
+	up.mu.Unlock()
+}
+
+func (up *UpdateProgram) isStopped() bool {
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	return up.stopped
+}
+
+//targetLog 日志前加上目标的serverID,并行更新时多个目标的日志交错在一起也能区分
+type targetLog struct {
+	prefix string
+}
+
+func (up *UpdateProgram) log(k string) targetLog {
+	return targetLog{prefix: "[serverID:" + k + "]"}
+}
+
+func (tl targetLog) InfoDoo(v ...interface{}) {
+	logU.InfoDoo(append([]interface{}{tl.prefix}, v...)...)
+}
+
+func (tl targetLog) ErrorDoo(v ...interface{}) {
+	logU.ErrorDoo(append([]interface{}{tl.prefix}, v...)...)
+}
+
+//InfoDooEx 只记录到日志文件中
+func (tl targetLog) InfoDooEx(v ...interface{}) {
+	logUEx.InfoDoo(append([]interface{}{tl.prefix}, v...)...)
+}
+
+//updateError 目标更新失败的操作和原因
+type updateError struct {
+	op  string
+	err error
+}
+
+func (e *updateError) Error() string {
+	return e.op + " fail: " + e.err.Error()
+}
+
+//updateTarget 更新一个目标:备份并替换文件,校验版本后重启服务,任何一步失败时按相反的顺序撤销本次的操作,成功后才清理多余的备份文件
+//配置了钩子时在备份前,拷贝后,重启前和重启后执行,钩子失败与重启失败一样处理,回滚后执行hook_on_failure
+func (up *UpdateProgram) updateTarget(k string) error {
+	start := up.mark()
+	up.journal.Target(k)
+	env := up.hookEnv(k, up.exeVersion(k))
+
+	err := up.runHook(k, Hook_Pre_Backup, env)
+	if err == nil {
+		err = up.replaceFiles(k)
+	}
+	if err == nil {
+		err = up.runHook(k, Hook_Post_Copy, env)
+	}
+	if err == nil {
+		err = up.verifyVersion(k, up.exe_version)
+	}
+	if err == nil {
+		err = up.runHook(k, Hook_Pre_Restart, env)
+	}
+	restarted := false
+	if err == nil {
+		restarted = true
+		if !up.restart(k) {
+			err = &updateError{Action_Restart, fmt.Errorf("service %s is not running, please check: %s", up.target_service[k], up.target_exe_file[k])}
+		}
+	}
+	if err == nil {
+		err = up.runHook(k, Hook_Post_Restart, env)
+	}
+	if err != nil {
+		up.log(k).ErrorDoo("update", err)
+		up.rollback(k, start, restarted)
+		up.runFailureHook(k, env, err)
+		up.journal.TargetEnd(k, err)
+		return err
+	}
+
+	up.pruneBackups(k)
+	up.journal.TargetEnd(k, nil)
+	if !up.dry_run {
+		up.log(k).InfoDooEx("File:", up.target_exe_file[k], "update success and restart success version is:", up.exe_version)
+	}
+	return nil
+}
+
+//replaceFiles 先把目标的exe及会被覆盖的文件重命名备份,再拷贝源文件,最后把拷贝过去的主程序重命名为对应服务的名字
+func (up *UpdateProgram) replaceFiles(k string) error {
+	PthSep := string(os.PathSeparator)
+	v := up.target_dir[k]
+	curName, ok := up.target_exe_file[k]
+	if !ok {
+		return &updateError{Action_Backup, fmt.Errorf("serverID %s not exist correspond exe file", k)}
+	}
+
+	//目标的exe文件以及除了主程序外会被覆盖的文件存在时先进行重命名,同一次的备份使用相同的标记
+	exeFileName, _ := GetFileNameByPath(curName)
+	backup := make([]string, 0)
+	if FileIsExisted(curName) {
+		backup = append(backup, exeFileName)
+	}
+	for _, name := range sortedKeys(up.source_file) {
+		if up.source_file[name] != up.source_exe_file && FileIsExisted(v+PthSep+name) {
+			backup = append(backup, name)
 		}
+	}
+	backNames := GetNotDittoBackupNames(v, backup, up.author)
+	for _, name := range backup {
+		if err := up.rename(k, Action_Backup, v+PthSep+name, backNames[name]); err != nil {
+			return &updateError{Action_Backup, err}
+		}
+	}
 
-		//获取更新后的exe文件的版本号,并判断是否更新成功
+	//拷贝文件
+	for _, name := range sortedKeys(up.source_file) {
+		if err := up.copyFile(k, v, up.source_file[name]); err != nil {
+			return &updateError{Action_Copy, err}
+		}
+	}
+
+	//拷贝文件结束后需要对exe程序进行重命名为对应服务的名字
+	exeName, _ := GetFileNameByPath(up.source_exe_file)
+	if dstExePath := v + PthSep + exeName; dstExePath != curName {
+		if err := up.rename(k, Action_Rename, dstExePath, curName); err != nil {
+			return &updateError{Action_Rename, err}
+		}
+	}
+	return nil
+}
+
+//verifyVersion 获取目标exe文件的版本号,并判断是否为version,预演时文件没有实际拷贝不做判断
+func (up *UpdateProgram) verifyVersion(k, version string) error {
+	up.record(k, Action_Verify, up.target_exe_file[k], "")
+	if up.dry_run {
+		return nil
+	}
+
+	err := up.do(k, Action_Verify, up.target_exe_file[k], "", func() error {
 		fi := fileInfo{FilePath: up.target_exe_file[k]}
 		fi.GetExeVersion()
-		if fi.Version == up.exe_version {
-			//更新成功进行多余备份文件处理，最多保留up.backup_file_num个exe文件,多余的删除
-			ClearBackupFileBySuffix(v, up.server_prefix+k+".exe", []string{"exe"}, up.backup_file_num)
-
-			//重启服务，内部会等待直到服务启动或者启动超时(内部标识决定某个服务重启失败是否要继续更新其它的)
-			if !RestartServer(up.server_prefix + k) {
-				logUEx.ErrorDoo("RestartServer:", up.server_prefix+k, "fail please check:", up.target_exe_file[k])
-				fail++
-				failServerName = append(failServerName, up.server_prefix+k)
-				if up.update_stop_flag == Update_Stop {
-					goto errorEnd
-				} else if up.update_stop_flag == Update_Continue {
-					logU.InfoDoo("Update progress[success:", success, "fail:", fail, "total:", len(up.target_dir))
-					continue
-				} else {
-					logU.ErrorDoo("don't know update_stop_flag", up.update_stop_flag)
-					goto errorEnd
-				}
-			}
+		if fi.Version != version {
+			return fmt.Errorf("version of %s is %s not %s", up.target_exe_file[k], fi.Version, version)
+		}
+		return nil
+	})
+	if err != nil {
+		return &updateError{Action_Verify, err}
+	}
+	return nil
+}
+
+//rollback 按相反的顺序撤销目标从第start个开始的操作(并行时跳过其它目标的操作),用本次的备份还原所有文件,restarted为true时重启服务使旧版本重新运行
+func (up *UpdateProgram) rollback(k string, start int, restarted bool) {
+	up.mu.Lock()
+	actions := append([]*UpdateAction{}, up.actions[start:]...)
+	up.mu.Unlock()
 
-			//存储更新成功的程序的服务名
-			successServerName = append(successServerName, up.server_prefix+k)
-			logUEx.InfoDoo("File:", up.target_exe_file[k], "update success and restart success version is:", fi.Version)
+	restored := true
+	for i := len(actions) - 1; i >= 0; i-- {
+		a := actions[i]
+		if a.ServerID != k {
+			continue
+		}
+		var err error
+		switch a.Op {
+		case Action_Backup, Action_Rename, Action_Restore:
+			//resume时操作可能已经撤销过
+			if !FileIsExisted(a.Dest) && FileIsExisted(a.Path) {
+				break
+			}
+			err = os.Rename(a.Dest, a.Path)
+		case Action_Copy:
+			//拷贝前同名的文件已经备份,直接删除拷贝过去的文件
+			if err = os.Remove(a.Dest); os.IsNotExist(err) {
+				err = nil
+			}
+		}
+		if err != nil {
+			restored = false
+			up.log(k).ErrorDoo("Roll back", a.String(), "fail:", err)
 		} else {
-			logU.ErrorDoo("File:", up.target_exe_file[k], "update fail version is:", fi.Version, "please check exe_version is match")
-			fail++
-			failServerName = append(failServerName, up.server_prefix+k)
-			goto errorEnd
+			up.journal.Step(k, a.Op, a.Path, a.Dest, Step_Undone)
 		}
+	}
 
-		success++
-		logU.InfoDoo("Update progress[success:", success, "fail:", fail, "total:", len(up.target_dir))
+	if restarted && !RestartServer(up.target_service[k]) {
+		restored = false
+		up.log(k).ErrorDoo("Roll back restart service", up.target_service[k], "fail")
 	}
 
-	return
-errorEnd:
-	logU.InfoDoo("Update progress[success:", success, "fail:", fail, "total:", len(up.target_dir))
-	return
+	fi := fileInfo{FilePath: up.target_exe_file[k]}
+	fi.GetExeVersion()
+	if restored {
+		up.log(k).InfoDoo("roll back success version is:", fi.Version)
+	} else {
+		up.log(k).ErrorDoo("roll back fail version is:", fi.Version, "please check:", up.target_dir[k])
+	}
+}
+
+//pruneBackups 更新成功后清理多余的备份文件,每个文件最多保留up.backup_file_num个
+func (up *UpdateProgram) pruneBackups(k string) {
+	v := up.target_dir[k]
+	for _, name := range sortedKeys(up.source_file) {
+		if up.source_file[name] != up.source_exe_file {
+			up.prune(k, GetBackupFileByMatch(v, name, []string{GetFileNameSuffixByPath(name)}, up.backup_file_num, up.pending))
+		}
+	}
+
+	exeFileName, _ := GetFileNameByPath(up.target_exe_file[k])
+	up.prune(k, GetBackupFileBySuffix(v, exeFileName, []string{"exe"}, up.backup_file_num, up.pending))
 }
 
 func RestartServer(name string) bool {
@@ -249,6 +586,26 @@ func GetNotDittoFileName(dir, prefix, midWord, suffix string) string {
 	return "GetNotDittoFileNameError"
 }
 
+//GetNotDittoBackupNames 获取目录下多个文件的不重复的备份文件名,所有文件使用相同的标记,回滚时按标记找到同一次备份的文件
+func GetNotDittoBackupNames(dir string, names []string, midWord string) map[string]string {
+	PthSep := string(os.PathSeparator)
+	t := time.Now().Format("20060102")
+	for i := 0; ; i++ {
+		backNames := make(map[string]string, len(names))
+		ditto := false
+		for _, name := range names {
+			backNames[name] = dir + PthSep + GetFileNamePrefixByFile(name) + "(" + midWord + t + "_" + strconv.Itoa(i) + ")" + GetFileNameSuffixByPath(name)
+			if FileIsExisted(backNames[name]) {
+				ditto = true
+				break
+			}
+		}
+		if !ditto {
+			return backNames
+		}
+	}
+}
+
 //文件属性,用于根据修改时间排序文件
 type FileAttr struct {
 	path       string
@@ -284,65 +641,99 @@ func (list FileAttrList) Swap(i, j int) {
 
 //清理备份文件通过文件后缀的方式(对于某个目录下的某种文件类型,除了当前在使用的那个外，最多能保留多少个，多余的就删除掉)
 func ClearBackupFileBySuffix(fileDir, fileName string, suffixs []string, num int) {
+	for _, v := range GetBackupFileBySuffix(fileDir, fileName, suffixs, num, nil) {
+		os.Remove(v)
+	}
+}
+
+//GetBackupFileBySuffix 获取ClearBackupFileBySuffix会删除的文件,pending为预演时还没有实际发生的文件变化
+func GetBackupFileBySuffix(fileDir, fileName string, suffixs []string, num int, pending map[string]int64) []string {
 	PthSep := string(os.PathSeparator)
 	needOpList := make([]*FileAttr, 0)
 	retainFile := fileDir + PthSep + fileName
-	if curFileList, err := GetFiles(fileDir, suffixs, false); err == nil {
-		if len(curFileList) > num {
-			for _, v := range curFileList {
-				if retainFile != v {
-					needOpList = append(needOpList, &FileAttr{v, GetFileModTime(v)})
-				}
-			}
-		}
-
-		//根据修改时间对文件进行排序
-		sort.Sort(FileAttrList(needOpList))
+	curFileList, err := listBackupFiles(fileDir, suffixs, pending)
+	if err != nil {
+		return nil
+	}
 
-		//删除掉创建时间比较久的文件
-		if len(needOpList) > num {
-			deleteNum := len(needOpList) - num
-			for i := 0; i < deleteNum; i++ {
-				os.Remove(needOpList[i].path)
+	if len(curFileList) > num {
+		for _, v := range curFileList {
+			if retainFile != v.path {
+				needOpList = append(needOpList, v)
 			}
 		}
-
 	}
+
+	return oldestFiles(needOpList, num)
 }
 
 //清理备份文件通过文件名部分匹配的方式(除了当前在使用的那个外，最多能保留多少个，多余的就删除掉)
 func ClearBackupFileByMatch(fileDir, fileName string, suffixs []string, num int) {
+	for _, v := range GetBackupFileByMatch(fileDir, fileName, suffixs, num, nil) {
+		os.Remove(v)
+	}
+}
+
+//GetBackupFileByMatch 获取ClearBackupFileByMatch会删除的文件,pending为预演时还没有实际发生的文件变化
+func GetBackupFileByMatch(fileDir, fileName string, suffixs []string, num int, pending map[string]int64) []string {
 	PthSep := string(os.PathSeparator)
 	needOpList := make([]*FileAttr, 0)
 	retainFile := fileDir + PthSep + fileName
-	if curFileList, err := GetFiles(fileDir, suffixs, false); err == nil {
-		thisFileList := make([]string, 0)
-		for _, v := range curFileList {
-			if retainFile != v && GetSourceFileByBack(v) == fileName {
-				thisFileList = append(thisFileList, v)
-			}
-		}
+	curFileList, err := listBackupFiles(fileDir, suffixs, pending)
+	if err != nil {
+		return nil
+	}
 
-		if len(thisFileList) > num {
-			for _, v := range thisFileList {
-				needOpList = append(needOpList, &FileAttr{v, GetFileModTime(v)})
-			}
-		} else {
-			return
+	for _, v := range curFileList {
+		if retainFile != v.path && GetSourceFileByBack(v.path) == fileName {
+			needOpList = append(needOpList, v)
 		}
+	}
+	if len(needOpList) <= num {
+		return nil
+	}
 
-		//根据修改时间对文件进行排序
-		sort.Sort(FileAttrList(needOpList))
+	return oldestFiles(needOpList, num)
+}
 
-		//删除掉创建时间比较久的文件
-		if len(needOpList) > num {
-			deleteNum := len(needOpList) - num
-			for i := 0; i < deleteNum; i++ {
-				os.Remove(needOpList[i].path)
+//listBackupFiles 获取目录下指定后缀的文件及修改时间,pending中的文件路径 + 修改时间覆盖实际的文件,修改时间为-1表示文件已不存在
+func listBackupFiles(fileDir string, suffixs []string, pending map[string]int64) ([]*FileAttr, error) {
+	curFileList, err := GetFiles(fileDir, suffixs, false)
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]*FileAttr, 0, len(curFileList))
+	for _, v := range curFileList {
+		if _, ok := pending[v]; !ok {
+			list = append(list, &FileAttr{v, GetFileModTime(v)})
+		}
+	}
+
+	PthSep := string(os.PathSeparator)
+	for v, modifyTime := range pending {
+		if modifyTime < 0 || !strings.HasPrefix(v, fileDir+PthSep) || strings.Contains(v[len(fileDir)+1:], PthSep) {
+			continue
+		}
+		for _, suffix := range suffixs {
+			if strings.HasSuffix(v, suffix) {
+				list = append(list, &FileAttr{v, modifyTime})
+				break
 			}
 		}
+	}
+	return list, nil
+}
+
+//oldestFiles 根据修改时间对文件进行排序,获取除了最新的num个以外的文件
+func oldestFiles(list []*FileAttr, num int) []string {
+	sort.Sort(FileAttrList(list))
 
+	files := make([]string, 0)
+	for i := 0; i < len(list)-num; i++ {
+		files = append(files, list[i].path)
 	}
+	return files
 }
 
 //获取文件修改时间 返回unix时间戳
@@ -363,18 +754,16 @@ func GetFileModTime(path string) int64 {
 	return fi.ModTime().Unix()
 }
 
-//把文件从源路径复制到目标目录下
+//把文件从源路径复制到目标目录下,错误中包含完整的源文件和目标文件路径,由调用者按目标记录日志
 func CopyFile(dstFileDir string, srcFilePath string) (err error) {
 	srcFile, err := os.Open(srcFilePath)
 	if err != nil {
-		logU.ErrorDoo("打开源文件错误，错误信息", err, srcFilePath)
-		return err
+		return fmt.Errorf("open source file %s: %v", srcFilePath, err)
 	}
 	defer srcFile.Close()
 
 	var dstName string
 	if dstName, err = GetFileNameByPath(srcFilePath); err != nil {
-		logU.ErrorDoo(err)
 		return err
 	}
 
@@ -383,10 +772,10 @@ func CopyFile(dstFileDir string, srcFilePath string) (err error) {
 	fi, _ := srcFile.Stat()
 	perm := fi.Mode()
 
-	dstFile, err := os.OpenFile(dstFileDir+PthSep+dstName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, perm)
+	dstPath := dstFileDir + PthSep + dstName
+	dstFile, err := os.OpenFile(dstPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, perm)
 	if err != nil {
-		logU.ErrorDoo("打开目标文件错误，错误信息", err, dstName)
-		return err
+		return fmt.Errorf("open target file %s: %v", dstPath, err)
 	}
 	defer dstFile.Close()
 
@@ -394,64 +783,45 @@ func CopyFile(dstFileDir string, srcFilePath string) (err error) {
 	for {
 		n, err := srcFile.Read(buf)
 		if err != nil && err != io.EOF {
-			return err
+			return fmt.Errorf("read source file %s: %v", srcFilePath, err)
 		}
 		if n == 0 {
 			break
 		}
 		if _, err := dstFile.Write(buf[:n]); err != nil {
-			return err
+			return fmt.Errorf("write target file %s: %v", dstPath, err)
 		}
 	}
 
 	return nil
 }
 
-//获取当前路径下的目录
-func GetCurDirList(path, server_type, filter string) (dirmap map[string]string, err error) {
-	dir, err := ioutil.ReadDir(path)
+//获取目录布局下的所有目标目录,selector决定哪些serverID目录需要更新(为nil表示全部),vars为每个serverID在布局中捕获的变量
+func GetCurDirList(layout *TargetLayout, selector *TargetSelector) (dirmap map[string]string, vars map[string]map[string]string, err error) {
+	list, err := DiscoverLayout(layout, nil, selector)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	PthSep := string(os.PathSeparator)
 	dirmap = make(map[string]string, 0)
-
-	for _, fi := range dir {
-		if fi.IsDir() {
-
-			//过滤掉不需要更新的子服务
-			if strings.Contains(filter, fi.Name()) {
-				continue
-			}
-
-			//获取子目录
-			subDir, err := ioutil.ReadDir(path + PthSep + fi.Name())
-			if err != nil {
-				logU.ErrorDoo(err)
-				continue
-			}
-
-			count := 0
-			subDirName := ""
-			for _, subFi := range subDir {
-				if subFi.IsDir() && strings.Contains(subFi.Name(), server_type) {
-					count++
-					subDirName = subFi.Name()
-				}
-			}
-
-			//只允许存在一个该类型的子文件如E:\tradesystem\server_id\trade4 不能还存在E:\tradesystem\server_id\MT4这种的
-			if count == 1 {
-				dirmap[fi.Name()] = path + PthSep + fi.Name() + PthSep + subDirName
-			} else {
-				logUEx.InfoDoo("Please check in the path", path+PthSep+fi.Name(), "contians the server_type", server_type, "dir")
-			}
-
+	vars = make(map[string]map[string]string, 0)
+	for _, d := range list {
+		if d.Status == Discover_Selected {
+			dirmap[d.ServerID] = d.Dir
+			vars[d.ServerID] = d.Vars
 		}
 	}
+	return dirmap, vars, nil
+}
 
-	return dirmap, nil
+//sortedKeys 获取排序后的map的key
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
 }
 
 //GetFiles 获取指定目录下的所有文件,(all为true表示包含子目录下的文件 否则只是单前目录下的文件)
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+)
+
+//更新过程中对目标执行的操作
+const (
+	Action_Backup  = "backup"  //把目标文件重命名为GetNotDittoBackupNames得到的备份文件名
+	Action_Copy    = "copy"    //把源文件拷贝到目标目录
+	Action_Rename  = "rename"  //把拷贝过去的主程序重命名为目标exe
+	Action_Verify  = "verify"  //校验目标exe的版本号
+	Action_Restore = "restore" //回滚时把备份文件重命名为原来的文件
+	Action_Prune   = "prune"   //删除多余的备份文件
+	Action_Restart = "restart" //重启服务
+	Action_Hook    = "hook"    //执行钩子命令
+)
+
+//UpdateAction 更新时对一个目标执行(预演时为将要执行)的一步操作,Dest只有备份,拷贝,重命名和还原才有
+type UpdateAction struct {
+	ServerID string `json:"server_id"`
+	Op       string `json:"op"`
+	Path     string `json:"path"`
+	Dest     string `json:"dest,omitempty"`
+}
+
+func (a *UpdateAction) String() string {
+	if len(a.Dest) == 0 {
+		return a.Op + " " + a.Path
+	}
+	return a.Op + " " + a.Path + " -> " + a.Dest
+}
+
+//SetDryRun 设置为预演模式,StartUpdate不做任何重命名,拷贝,删除和服务操作,只记录将要执行的操作
+func (up *UpdateProgram) SetDryRun(dryRun bool) {
+	up.dry_run = dryRun
+}
+
+//Actions 获取StartUpdate执行(预演时为将要执行)的所有操作,按执行的先后顺序
+func (up *UpdateProgram) Actions() []*UpdateAction {
+	return up.actions
+}
+
+func (up *UpdateProgram) record(k, op, path, dest string) {
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	up.actions = append(up.actions, &UpdateAction{ServerID: k, Op: op, Path: path, Dest: dest})
+}
+
+//mark 开始更新一个目标,返回当前已记录的操作数,预演时清空上个目标还没有实际发生的文件变化
+func (up *UpdateProgram) mark() int {
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	if up.dry_run {
+		up.pending = make(map[string]int64, 0)
+	}
+	return len(up.actions)
+}
+
+//do 执行一步操作,执行前后都写入更新日志,进程中途退出时resume据此判断操作是否可能已经执行
+func (up *UpdateProgram) do(k, op, path, dest string, fn func() error) error {
+	up.journal.Step(k, op, path, dest, Step_Start)
+	err := fn()
+	if err != nil {
+		up.journal.Step(k, op, path, dest, Step_Fail)
+	} else {
+		up.journal.Step(k, op, path, dest, Step_Done)
+	}
+	return err
+}
+
+//rename 重命名目标目录下的文件,成功后才记录以便失败时撤销,预演时只记录文件的变化供后续计算要删除的备份文件
+func (up *UpdateProgram) rename(k, op, from, to string) error {
+	if !up.dry_run {
+		err := up.do(k, op, from, to, func() error { return os.Rename(from, to) })
+		if err == nil {
+			up.record(k, op, from, to)
+		}
+		return err
+	}
+
+	up.record(k, op, from, to)
+
+	if modifyTime, ok := up.pending[from]; ok {
+		up.pending[to] = modifyTime
+	} else {
+		up.pending[to] = GetFileModTime(from)
+	}
+	up.pending[from] = -1
+	return nil
+}
+
+//copyFile 把源文件拷贝到目标目录下,失败时可能已经拷贝了部分内容,所以先记录,apply时拷贝后校验与计划一致
+func (up *UpdateProgram) copyFile(k, dir, src string) error {
+	name, _ := GetFileNameByPath(src)
+	up.record(k, Action_Copy, src, dir+string(os.PathSeparator)+name)
+	if !up.dry_run {
+		err := up.do(k, Action_Copy, src, dir+string(os.PathSeparator)+name, func() error {
+			if err := CopyFile(dir, src); err != nil {
+				return err
+			}
+			return up.checkPlanned(name, dir+string(os.PathSeparator)+name)
+		})
+		if err != nil {
+			up.log(k).ErrorDoo("copy file failed", err)
+		}
+		return err
+	}
+
+	up.pending[dir+string(os.PathSeparator)+name] = time.Now().Unix()
+	return nil
+}
+
+//prune 删除多余的备份文件
+func (up *UpdateProgram) prune(k string, files []string) {
+	for _, v := range files {
+		up.record(k, Action_Prune, v, "")
+		if !up.dry_run {
+			up.do(k, Action_Prune, v, "", func() error { return os.Remove(v) })
+		}
+	}
+}
+
+//restart 重启目标的服务,预演时认为重启成功
+func (up *UpdateProgram) restart(k string) bool {
+	up.record(k, Action_Restart, up.target_service[k], "")
+	if up.dry_run {
+		return true
+	}
+	err := up.do(k, Action_Restart, up.target_service[k], "", func() error {
+		if !RestartServer(up.target_service[k]) {
+			return fmt.Errorf("restart service %s fail", up.target_service[k])
+		}
+		return nil
+	})
+	return err == nil
+}
+
+//DryRunAll 预演所有组件的更新,输出并记录到日志中每个目标将要执行的操作,不会修改任何文件和服务
+func DryRunAll(updateCfg *UpdateCfg) {
+	for _, comp := range updateCfg.Components() {
+		if name := comp.Name(); len(name) > 0 {
+			fmt.Fprintf(os.Stdout, "\r\n==== component: %s ====\r\n", name)
+		}
+
+		updateProgram := NewUpdateProgram()
+		if err := updateProgram.Load(comp); err != nil {
+			continue
+		}
+		updateProgram.SetDryRun(true)
+		updateProgram.StartUpdate()
+
+		var sb strings.Builder
+		PrintActions(&sb, updateProgram.target_display, updateProgram.Actions())
+		fmt.Fprint(os.Stdout, sb.String())
+		logUEx.InfoDoo("Dry run actions:", "\r\n"+sb.String())
+	}
+}
+
+//PrintActions 按目标分组输出操作,display为serverID + 显示名
+func PrintActions(w io.Writer, display map[string]string, actions []*UpdateAction) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	last := ""
+	for _, a := range actions {
+		if a.ServerID != last {
+			fmt.Fprintf(tw, "\r\nserverID %s (%s):\r\n", a.ServerID, display[a.ServerID])
+			last = a.ServerID
+		}
+		if len(a.Dest) == 0 {
+			fmt.Fprintf(tw, "  %s\t%s\r\n", a.Op, a.Path)
+		} else {
+			fmt.Fprintf(tw, "  %s\t%s -> %s\r\n", a.Op, a.Path, a.Dest)
+		}
+	}
+	tw.Flush()
+	fmt.Fprintf(w, "\r\ntotal %d actions\r\n", len(actions))
+}
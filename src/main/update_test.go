@@ -0,0 +1,31 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+)
+
+//不是updateError的错误不知道是哪一步失败,停止更新而不是panic
+func TestStopOn(t *testing.T) {
+	cases := []struct {
+		err      error
+		stopFlag int
+		want     bool
+	}{
+		{&updateError{Action_Verify, errors.New("version")}, Update_Continue, true},
+		{&updateError{Action_Restart, errors.New("restart")}, Update_Continue, false},
+		{&updateError{Action_Restart, errors.New("restart")}, Update_Stop, true},
+		{&updateError{Action_Copy, errors.New("copy")}, Update_Stop, false},
+		{fmt.Errorf("wrapped: %w", &updateError{Action_Hook, errors.New("hook")}), Update_Stop, true},
+		{errors.New("plain"), Update_Continue, true},
+	}
+	for _, c := range cases {
+		up := NewUpdateProgram()
+		up.update_stop_flag = c.stopFlag
+		if got := up.stopOn("1001", c.err); got != c.want {
+			t.Errorf("stopOn(%v) with update_stop_flag %d = %v, want %v", c.err, c.stopFlag, got, c.want)
+		}
+	}
+}